@@ -0,0 +1,183 @@
+package ocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"ocache/bloom"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrBloomRejected is returned by Get when the Bloom filter proves the key
+// does not exist, so neither a peer nor the Getter was asked.
+var ErrBloomRejected = errors.New("rejected by bloom filter")
+
+// A KeySource enumerates every key that exists in the data source, it
+// is used to populate the Bloom filter of a Group.
+type KeySource interface {
+	Keys(ctx context.Context, fn func(key string)) error
+}
+
+// A KeySourceFunc implements KeySource with a function.
+type KeySourceFunc func(ctx context.Context, fn func(key string)) error
+
+// Keys implements KeySource interface function
+func (f KeySourceFunc) Keys(ctx context.Context, fn func(key string)) error {
+	return f(ctx, fn)
+}
+
+// BloomStats describe the Bloom filter of a Group.
+type BloomStats struct {
+	Bits                       uint    `json:"bits"`
+	Hashes                     uint    `json:"hashes"`
+	Keys                       uint64  `json:"keys"`
+	FillRatio                  float64 `json:"fill_ratio"`
+	TargetFalsePositiveRate    float64 `json:"target_false_positive_rate"`
+	EstimatedFalsePositiveRate float64 `json:"estimated_false_positive_rate"`
+}
+
+// bloomGuard rejects lookups of keys that are not in the data source.
+// Readers load the filter atomically and never wait for a rebuild.
+type bloomGuard struct {
+	n   uint    // expected number of keys
+	p   float64 // target false-positive rate
+	src KeySource
+
+	filter atomic.Value // *bloom.Filter, unset until the first build or load
+
+	mu       sync.Mutex    // guards building
+	building *bloom.Filter // the filter being rebuilt, if any
+}
+
+// WithBloomFilter guards loads with a Bloom filter sized for n keys at a
+// false-positive rate of p. When src is not nil the filter is built from
+// it in background, until then every key is let through. src may be nil
+// when the filter is loaded with LoadBloomFilter instead. It panics
+// unless 0 < p < 1.
+func WithBloomFilter(n uint, p float64, src KeySource) GroupOption {
+	if !(p > 0 && p < 1) {
+		panic(fmt.Sprintf("bloom filter false-positive rate %v out of (0, 1)", p))
+	}
+	return func(g *Group) {
+		g.bloom = &bloomGuard{n: n, p: p, src: src}
+	}
+}
+
+// current returns the filter in use, or nil
+func (b *bloomGuard) current() *bloom.Filter {
+	f, _ := b.filter.Load().(*bloom.Filter)
+	return f
+}
+
+// allow reports whether key may exist
+func (b *bloomGuard) allow(key string) bool {
+	f := b.current()
+	return f == nil || f.Test(key)
+}
+
+// rebuild populates a fresh filter from src and swaps it in
+func (b *bloomGuard) rebuild(ctx context.Context) error {
+	if b.src == nil {
+		return fmt.Errorf("bloom filter has no KeySource")
+	}
+	f := bloom.NewWithEstimates(b.n, b.p)
+	b.mu.Lock()
+	if b.building != nil {
+		b.mu.Unlock()
+		return fmt.Errorf("bloom filter rebuild already in progress")
+	}
+	b.building = f
+	b.mu.Unlock()
+
+	err := b.src.Keys(ctx, f.Add)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.building = nil
+	if err != nil {
+		return err
+	}
+	b.filter.Store(f)
+	return nil
+}
+
+// add adds key to the filter in use and to the one being rebuilt
+func (b *bloomGuard) add(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f := b.current(); f != nil {
+		f.Add(key)
+	}
+	if b.building != nil {
+		b.building.Add(key)
+	}
+}
+
+// RebuildBloomFilter repopulates the Bloom filter from its KeySource in
+// background. The old filter keeps serving until the new one is ready.
+// The returned channel receives the result once the rebuild is over.
+func (g *Group) RebuildBloomFilter(ctx context.Context) <-chan error {
+	done := make(chan error, 1)
+	if g.bloom == nil {
+		done <- fmt.Errorf("group %s has no bloom filter", g.name)
+		return done
+	}
+	go func() {
+		done <- g.bloom.rebuild(ctx)
+	}()
+	return done
+}
+
+// LoadBloomFilter replaces the Bloom filter with a snapshot written by
+// SaveBloomFilter.
+func (g *Group) LoadBloomFilter(r io.Reader) error {
+	if g.bloom == nil {
+		return fmt.Errorf("group %s has no bloom filter", g.name)
+	}
+	f := new(bloom.Filter)
+	if _, err := f.ReadFrom(r); err != nil {
+		return err
+	}
+	g.bloom.filter.Store(f)
+	return nil
+}
+
+// SaveBloomFilter writes a snapshot of the Bloom filter to w.
+func (g *Group) SaveBloomFilter(w io.Writer) error {
+	if g.bloom == nil || g.bloom.current() == nil {
+		return fmt.Errorf("group %s has no bloom filter", g.name)
+	}
+	_, err := g.bloom.current().WriteTo(w)
+	return err
+}
+
+// AddToBloomFilter records that key now exists in the data source.
+// Keys created after the last build are rejected until they are added
+// here or the filter is rebuilt.
+func (g *Group) AddToBloomFilter(key string) {
+	if g.bloom != nil {
+		g.bloom.add(key)
+	}
+}
+
+// BloomStats returns stats about the Bloom filter, ok is false when the
+// group has none or it is not built yet.
+func (g *Group) BloomStats() (stats BloomStats, ok bool) {
+	if g.bloom == nil {
+		return
+	}
+	f := g.bloom.current()
+	if f == nil {
+		return
+	}
+	return BloomStats{
+		Bits:                       f.Cap(),
+		Hashes:                     f.K(),
+		Keys:                       f.Count(),
+		FillRatio:                  f.FillRatio(),
+		TargetFalsePositiveRate:    g.bloom.p,
+		EstimatedFalsePositiveRate: f.EstimatedFalsePositiveRate(),
+	}, true
+}
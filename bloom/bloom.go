@@ -0,0 +1,198 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// magic marks the start of a serialized Filter
+const magic = "OBF1"
+
+// ErrBadFormat is returned by ReadFrom when the input is not a Filter
+var ErrBadFormat = errors.New("bloom: bad format")
+
+const (
+	// maxBits is the largest filter ReadFrom accepts, 4 GiB of bits
+	maxBits = 1 << 35
+	// maxHashes is the most hash functions a Filter uses
+	maxHashes = 64
+)
+
+// Filter is a Bloom filter, it answers "definitely not present" or
+// "maybe present" for a key. Add and Test are safe for concurrent use.
+type Filter struct {
+	m     uint64   // number of bits
+	k     uint64   // number of hash functions
+	words []uint64 // the bit array, updated atomically
+	n     uint64   // keys added so far
+}
+
+// New creates a Filter with m bits and k hash functions, k is at most 64
+func New(m, k uint) *Filter {
+	if m == 0 {
+		m = 1
+	}
+	if k == 0 {
+		k = 1
+	}
+	if k > maxHashes {
+		k = maxHashes
+	}
+	return &Filter{
+		m:     uint64(m),
+		k:     uint64(k),
+		words: make([]uint64, (m+63)/64),
+	}
+}
+
+// NewWithEstimates creates a Filter sized for n keys at a false-positive rate of p
+func NewWithEstimates(n uint, p float64) *Filter {
+	m, k := EstimateParameters(n, p)
+	return New(m, k)
+}
+
+// EstimateParameters returns the bits m and hash functions k needed to
+// hold n keys at a false-positive rate of p. It panics unless 0 < p < 1.
+func EstimateParameters(n uint, p float64) (m, k uint) {
+	if !(p > 0 && p < 1) {
+		panic(fmt.Sprintf("bloom: false-positive rate %v out of (0, 1)", p))
+	}
+	if n == 0 {
+		n = 1
+	}
+	m = uint(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k = uint(math.Ceil(math.Ln2 * float64(m) / float64(n)))
+	return m, k
+}
+
+// locations derives the k bit positions of key by double hashing
+func (f *Filter) locations(key string, fn func(i uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := mix(h1) | 1 // odd, so the k positions don't repeat early
+	for i := uint64(0); i < f.k; i++ {
+		if !fn((h1 + i*h2) % f.m) {
+			return
+		}
+	}
+}
+
+// mix is the splitmix64 finalizer
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add adds key to the filter
+func (f *Filter) Add(key string) {
+	f.locations(key, func(i uint64) bool {
+		addr, mask := &f.words[i/64], uint64(1)<<(i%64)
+		for {
+			old := atomic.LoadUint64(addr)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(addr, old, old|mask) {
+				return true
+			}
+		}
+	})
+	atomic.AddUint64(&f.n, 1)
+}
+
+// Test reports whether key may be in the filter. false means key was
+// definitely never added.
+func (f *Filter) Test(key string) bool {
+	present := true
+	f.locations(key, func(i uint64) bool {
+		present = atomic.LoadUint64(&f.words[i/64])&(uint64(1)<<(i%64)) != 0
+		return present
+	})
+	return present
+}
+
+// Cap returns the number of bits
+func (f *Filter) Cap() uint {
+	return uint(f.m)
+}
+
+// K returns the number of hash functions
+func (f *Filter) K() uint {
+	return uint(f.k)
+}
+
+// Count returns how many times Add was called
+func (f *Filter) Count() uint64 {
+	return atomic.LoadUint64(&f.n)
+}
+
+// FillRatio returns the fraction of bits that are set
+func (f *Filter) FillRatio() float64 {
+	set := 0
+	for i := range f.words {
+		set += bits.OnesCount64(atomic.LoadUint64(&f.words[i]))
+	}
+	return float64(set) / float64(f.m)
+}
+
+// EstimatedFalsePositiveRate estimates the chance that Test returns
+// true for a key never added, from the bits currently set
+func (f *Filter) EstimatedFalsePositiveRate() float64 {
+	return math.Pow(f.FillRatio(), float64(f.k))
+}
+
+// WriteTo writes the filter in a binary form that ReadFrom accepts
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, len(magic)+24+8*len(f.words))
+	copy(buf, magic)
+	off := len(magic)
+	binary.BigEndian.PutUint64(buf[off:], f.m)
+	binary.BigEndian.PutUint64(buf[off+8:], f.k)
+	binary.BigEndian.PutUint64(buf[off+16:], f.Count())
+	off += 24
+	for i := range f.words {
+		binary.BigEndian.PutUint64(buf[off+8*i:], atomic.LoadUint64(&f.words[i]))
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFrom replaces the filter with one written by WriteTo. Filters of
+// more than 2^35 bits or 64 hash functions are rejected as ErrBadFormat.
+// It must not be called while the filter is in use.
+func (f *Filter) ReadFrom(r io.Reader) (int64, error) {
+	header := make([]byte, len(magic)+24)
+	n, err := io.ReadFull(r, header)
+	if err != nil {
+		return int64(n), err
+	}
+	if string(header[:len(magic)]) != magic {
+		return int64(n), ErrBadFormat
+	}
+	off := len(magic)
+	m := binary.BigEndian.Uint64(header[off:])
+	k := binary.BigEndian.Uint64(header[off+8:])
+	count := binary.BigEndian.Uint64(header[off+16:])
+	if m == 0 || m > maxBits || k == 0 || k > maxHashes {
+		return int64(n), ErrBadFormat
+	}
+	body := make([]byte, 8*((m+63)/64))
+	nb, err := io.ReadFull(r, body)
+	if err != nil {
+		return int64(n + nb), err
+	}
+	words := make([]uint64, len(body)/8)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint64(body[8*i:])
+	}
+	f.m, f.k, f.n, f.words = m, k, count, words
+	return int64(n + nb), nil
+}
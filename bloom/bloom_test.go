@@ -0,0 +1,86 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add("key" + strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.Test("key" + strconv.Itoa(i)) {
+			t.Fatalf("key%d was added but Test returned false", i)
+		}
+	}
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if f.Test("missing" + strconv.Itoa(i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 10000; rate > 0.02 {
+		t.Fatalf("false positive rate %v, expect about 0.01", rate)
+	}
+	if est := f.EstimatedFalsePositiveRate(); est < 0.005 || est > 0.02 {
+		t.Fatalf("estimated false positive rate %v, expect about 0.01", est)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	f := NewWithEstimates(100, 0.01)
+	f.Add("Tom")
+	f.Add("Jack")
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var g Filter
+	if _, err := g.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Test("Tom") || !g.Test("Jack") || g.Count() != 2 || g.Cap() != f.Cap() || g.K() != f.K() {
+		t.Fatalf("filter changed after a round trip")
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader([]byte("not a filter at all, not at all"))); err != ErrBadFormat {
+		t.Fatalf("expect ErrBadFormat, got %v", err)
+	}
+
+	// headers that would overflow the body size or take too much memory
+	for _, mk := range [][2]uint64{{math.MaxUint64, 7}, {1 << 63, 7}, {maxBits + 1, 7}, {1024, 0}, {1024, maxHashes + 1}} {
+		header := make([]byte, len(magic)+24)
+		copy(header, magic)
+		binary.BigEndian.PutUint64(header[len(magic):], mk[0])
+		binary.BigEndian.PutUint64(header[len(magic)+8:], mk[1])
+		if _, err := g.ReadFrom(bytes.NewReader(header)); err != ErrBadFormat {
+			t.Fatalf("m=%d k=%d: expect ErrBadFormat, got %v", mk[0], mk[1], err)
+		}
+	}
+	if !g.Test("Tom") || g.Cap() != f.Cap() {
+		t.Fatalf("filter changed by a rejected read")
+	}
+}
+
+func TestEstimateParameters(t *testing.T) {
+	if f := NewWithEstimates(10, 1e-300); f.K() != maxHashes {
+		t.Fatalf("got %d hash functions, want at most %d", f.K(), maxHashes)
+	}
+	for _, p := range []float64{0, 1, -0.5, 2, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("false-positive rate %v was accepted", p)
+				}
+			}()
+			EstimateParameters(100, p)
+		}()
+	}
+}
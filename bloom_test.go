@@ -0,0 +1,119 @@
+package ocache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitBloom waits until the first build of g's Bloom filter is done
+func waitBloom(t *testing.T, g *Group) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := g.BloomStats(); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bloom filter of %s was not built", g.name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	loads := 0
+	keys := []string{"Tom", "Jack"}
+	release := make(chan struct{})
+	src := KeySourceFunc(func(ctx context.Context, fn func(key string)) error {
+		for _, key := range keys {
+			fn(key)
+		}
+		if len(keys) > 2 {
+			<-release // hold the rebuild
+		}
+		return nil
+	})
+	g := NewGroup("bloom", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(db[key]), nil
+		}), WithBloomFilter(100, 0.01, src))
+	waitBloom(t, g)
+
+	if v, err := g.Get("Tom"); err != nil || v.String() != "630" {
+		t.Fatalf("Tom should pass the bloom filter: %v", err)
+	}
+	if _, err := g.Get("Sam"); !errors.Is(err, ErrBloomRejected) {
+		t.Fatalf("Sam is not in the source, expect ErrBloomRejected, got %v", err)
+	}
+	if loads != 1 || g.Stats.BloomRejects.Get() != 1 {
+		t.Fatalf("loads = %d, rejects = %d", loads, g.Stats.BloomRejects.Get())
+	}
+
+	// readers keep using the old filter while a rebuild is in progress
+	keys = append(keys, "Sam")
+	done := g.RebuildBloomFilter(context.Background())
+	g.AddToBloomFilter("Sam")
+	if _, err := g.Get("Sam"); err != nil {
+		t.Fatalf("Sam was added to the filter: %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := g.BloomStats()
+	if stats.Keys != 3 || stats.EstimatedFalsePositiveRate > stats.TargetFalsePositiveRate {
+		t.Fatalf("unexpected bloom stats %+v", stats)
+	}
+
+	var buf bytes.Buffer
+	if err := g.SaveBloomFilter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewGroup("bloom-restored", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(db[key]), nil
+		}), WithBloomFilter(100, 0.01, nil))
+	if _, err := restored.Get("Unknown"); err != nil {
+		t.Fatalf("every key passes until a filter is loaded: %v", err)
+	}
+	if err := restored.LoadBloomFilter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Get("Sam"); err != nil {
+		t.Fatalf("Sam is in the snapshot: %v", err)
+	}
+	if _, err := restored.Get("Nobody"); !errors.Is(err, ErrBloomRejected) {
+		t.Fatalf("expect ErrBloomRejected, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a false-positive rate of 1 was accepted")
+		}
+	}()
+	WithBloomFilter(100, 1, nil)
+}
+
+func TestBloomRejectedByPeer(t *testing.T) {
+	owner := NewGroup("bloom-owner", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(db[key]), nil
+		}), WithBloomFilter(100, 0.01, KeySourceFunc(func(ctx context.Context, fn func(key string)) error {
+		fn("Tom")
+		return nil
+	})))
+	waitBloom(t, owner)
+
+	// the owner answers not found, not an error the caller would take for
+	// a failed peer before asking its own Getter
+	res, err := serveGet(context.Background(), owner, "Sam")
+	if err != nil || !res.NotFound {
+		t.Fatalf("rejected key got %v, %v", res, err)
+	}
+	if res, err := serveGet(context.Background(), owner, "Tom"); err != nil || string(res.Value) != "630" {
+		t.Fatalf("Tom got %v, %v", res, err)
+	}
+}
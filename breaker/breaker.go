@@ -0,0 +1,107 @@
+// Package breaker implements a circuit breaker, which stops calls to a
+// peer that keeps failing and lets one through now and then to find out
+// whether it came back.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// Open rejects calls until the cooldown has passed since the last
+	// failure.
+	Open
+	// HalfOpen lets a single trial call through, its outcome closes or
+	// opens the breaker again.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Breaker opens after a threshold of consecutive failures. It is safe for
+// concurrent use.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	failures int       // consecutive failures while closed
+	since    time.Time // of the last failure while open, of the trial while half-open
+}
+
+// New returns a closed Breaker that opens after threshold consecutive
+// failures and stays open for cooldown.
+func New(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow tells if a call may be made. Once the cooldown has passed an open
+// breaker turns half-open and allows a single trial, whose outcome must
+// be reported with Success or Failure. A trial that is never reported
+// is given up after another cooldown and a new one allowed.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Closed:
+		return true
+	case Open, HalfOpen:
+		now := b.now()
+		if now.Sub(b.since) < b.cooldown {
+			return false
+		}
+		b.state, b.since = HalfOpen, now
+		return true
+	}
+	return false
+}
+
+// Success reports a call that worked, it closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state, b.failures = Closed, 0
+}
+
+// Failure reports a call that failed. It opens the breaker after
+// threshold failures in a row, or at once when half-open, and an open
+// breaker waits for another cooldown.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Closed {
+		b.failures++
+		if b.failures < b.threshold {
+			return
+		}
+	}
+	b.state, b.failures, b.since = Open, 0, b.now()
+}
+
+// State returns the state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
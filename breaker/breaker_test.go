@@ -0,0 +1,82 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake time for a Breaker
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestBreaker(threshold int, cooldown time.Duration) (*Breaker, *clock) {
+	c := &clock{t: time.Unix(0, 0)}
+	b := New(threshold, cooldown)
+	b.now = c.now
+	return b, c
+}
+
+func TestThreshold(t *testing.T) {
+	b, _ := newTestBreaker(3, time.Second)
+	b.Failure()
+	b.Failure()
+	b.Success()
+	b.Failure()
+	b.Failure()
+	if b.State() != Closed || !b.Allow() {
+		t.Fatalf("a success should reset the count of failures, got %v", b.State())
+	}
+	b.Failure()
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("3 failures in a row should open the breaker, got %v", b.State())
+	}
+}
+
+func TestHalfOpen(t *testing.T) {
+	b, c := newTestBreaker(1, time.Second)
+	b.Failure()
+	c.t = c.t.Add(999 * time.Millisecond)
+	if b.Allow() {
+		t.Fatal("allowed a call before the cooldown")
+	}
+	c.t = c.t.Add(time.Millisecond)
+	if !b.Allow() || b.State() != HalfOpen {
+		t.Fatalf("no trial after the cooldown, got %v", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("allowed a second trial")
+	}
+
+	// a failed trial opens it for another cooldown
+	b.Failure()
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("a failed trial should reopen the breaker, got %v", b.State())
+	}
+	c.t = c.t.Add(time.Second)
+	if !b.Allow() {
+		t.Fatal("no trial after the second cooldown")
+	}
+	b.Success()
+	if b.State() != Closed || !b.Allow() || !b.Allow() {
+		t.Fatalf("a good trial should close the breaker, got %v", b.State())
+	}
+}
+
+func TestLostTrial(t *testing.T) {
+	b, c := newTestBreaker(1, time.Second)
+	b.Failure()
+	c.t = c.t.Add(time.Second)
+	if !b.Allow() {
+		t.Fatal("no trial after the cooldown")
+	}
+	// the trial never reports back
+	c.t = c.t.Add(500 * time.Millisecond)
+	if b.Allow() {
+		t.Fatal("allowed a second trial too early")
+	}
+	c.t = c.t.Add(500 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("a lost trial blocks the breaker")
+	}
+}
@@ -1,8 +1,11 @@
 package ocache
 
+import "time"
+
 // A ByteView holds an immutable view of bytes.
 type ByteView struct {
-	b []byte // b store cache value, b is read only
+	b []byte    // b store cache value, b is read only
+	e time.Time // e is the deadline of the value, zero means never expire
 }
 
 // Len returns the view's length
@@ -21,6 +24,11 @@ func (v ByteView) String() string {
 	return string(v.b)
 }
 
+// Expire returns the deadline of the view, or the zero time if it never expires.
+func (v ByteView) Expire() time.Time {
+	return v.e
+}
+
 func cloneBytes(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
@@ -2,34 +2,376 @@ package ocache
 
 import (
 	"ocache/lru"
+	"ocache/slab"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// cache splits cacheBytes across shards chosen by key hash, each with
+// its own store, so that readers of different keys do not serialize on
+// one mutex.
 type cache struct {
-	mu         sync.Mutex
-	lru        *lru.Cache
 	cacheBytes int64
 	K          int
 	historyMax int
+	crp        time.Duration // LRU-K correlated reference period
+	onEvicted  func(key string, value ByteView, reason lru.EvictReason)
+	newPolicy  func() lru.EvictionPolicy // nil means LRU-K with K and historyMax
+	nshards    int                       // 0 means a single shard
+	lockFree   bool                      // use lru.ConcurrentCache instead of a locked lru.Cache
+	cost       lru.CostFunc              // nil means lru.EstimatedCost
+	slab       bool                      // keep values in a slab.Cache, evicted FIFO by segment
+
+	// LRU-K history byte budget, shared with cacheBytes or on top of it
+	historyBytes  int64
+	sharedHistory bool
+	hashHistory   bool // keep key hashes in the history
+
+	once   sync.Once
+	shards []*cacheShard
 }
 
-func (c *cache) add(key string, value ByteView) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	// Lazy Initialization
-	if c.lru == nil {
-		c.lru = lru.New(c.K, c.cacheBytes, c.historyMax, nil)
-	}
-	c.lru.Add(key, value)
+// cacheShard is one store of a cache and its counters
+type cacheShard struct {
+	store      store
+	nhit, nget int64 // accessed atomically
 }
-func (c *cache) get(key string) (value ByteView, ok bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
+
+// store is the part of lru.Cache a shard needs, safe for concurrent use.
+// It is implemented by lockedStore, slabStore and lru.ConcurrentCache.
+type store interface {
+	Get(key string) (lru.Value, bool)
+	AddWithExpire(key string, value lru.Value, expire time.Time)
+	Remove(key string)
+	RemoveExpired(now time.Time) int
+	GetNBytes() int64
+	GetMaxBytes() int64
+	Len() int
+	Evictions() int64
+	HistoryLen() int
+	HistoryBytes() int64
+	Promotions() int64
+	Items() []lru.Item
+	Restore(items []lru.Item)
+}
+
+// init creates the shards on first use, after the GroupOptions are applied
+func (c *cache) init() {
+	c.once.Do(func() {
+		n := c.nshards
+		if n < 1 {
+			n = 1
+		}
+		var onEvicted func(string, lru.Value, lru.EvictReason)
+		if c.onEvicted != nil {
+			onEvicted = func(key string, value lru.Value, reason lru.EvictReason) {
+				c.onEvicted(key, value.(ByteView), reason)
+			}
+		}
+		cost := c.cost
+		if cost == nil {
+			cost = lru.EstimatedCost
+		}
+		c.shards = make([]*cacheShard, n)
+		for i := range c.shards {
+			// every shard gets an equal part of cacheBytes, 0 stays unlimited
+			maxBytes := shardBytes(c.cacheBytes, n)
+			var policy lru.EvictionPolicy
+			if c.newPolicy != nil {
+				policy = c.newPolicy()
+			} else {
+				policy = lru.NewLRUKWithConfig(lru.LRUKConfig{
+					K:                c.K,
+					HistoryMax:       c.historyMax,
+					HistoryBytes:     shardBytes(c.historyBytes, n),
+					SharedHistory:    c.sharedHistory,
+					HashKeys:         c.hashHistory,
+					CorrelatedPeriod: c.crp,
+				})
+			}
+			if c.slab {
+				c.shards[i] = &cacheShard{store: newSlabStore(maxBytes, c.onEvicted)}
+			} else if c.lockFree {
+				cc := lru.NewConcurrent(maxBytes, policy, onEvicted)
+				cc.SetCost(cost)
+				c.shards[i] = &cacheShard{store: cc}
+			} else {
+				lc := lru.NewWithPolicy(maxBytes, policy, onEvicted)
+				lc.SetCost(cost)
+				c.shards[i] = &cacheShard{store: &lockedStore{lru: lc}}
+			}
+		}
+	})
+}
+
+// fitEntries grows a cache sized as a share of total bytes so that it
+// has room for minSubCacheEntries empty entries, when its cost charges
+// each entry an overhead as lru.EstimatedCost does. It never grows past
+// total.
+func (c *cache) fitEntries(total int64) {
+	if total <= 0 {
 		return
 	}
-	if v, ok := c.lru.Get(key); ok {
+	cost := c.cost
+	if cost == nil {
+		cost = lru.EstimatedCost
+	}
+	min := minSubCacheEntries * cost("", ByteView{})
+	if min > total {
+		min = total
+	}
+	if c.cacheBytes < min {
+		c.cacheBytes = min
+	}
+}
+
+// shardBytes splits a limit of total bytes over n shards. A limit that
+// is smaller than n leaves 1 byte per shard rather than 0, which would
+// lift it.
+func shardBytes(total int64, n int) int64 {
+	if total <= 0 {
+		return total
+	}
+	if b := total / int64(n); b > 0 {
+		return b
+	}
+	return 1
+}
+
+// shard returns the shard owning key
+func (c *cache) shard(key string) *cacheShard {
+	c.init()
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	// inline FNV-1a, hash/fnv would allocate on every call
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+func (c *cache) add(key string, value ByteView) {
+	c.shard(key).store.AddWithExpire(key, value, value.Expire())
+}
+
+func (c *cache) get(key string) (value ByteView, ok bool) {
+	s := c.shard(key)
+	atomic.AddInt64(&s.nget, 1)
+	if v, ok := s.store.Get(key); ok {
+		atomic.AddInt64(&s.nhit, 1)
 		return v.(ByteView), true
 	}
 	return
 }
+
+// stats sums the counters of every shard
+func (c *cache) stats() CacheStats {
+	c.init()
+	var st CacheStats
+	for _, s := range c.shards {
+		st.Gets += atomic.LoadInt64(&s.nget)
+		st.Hits += atomic.LoadInt64(&s.nhit)
+		st.Bytes += s.store.GetNBytes()
+		st.MaxBytes += s.store.GetMaxBytes()
+		st.Items += int64(s.store.Len())
+		st.Evictions += s.store.Evictions()
+		st.HistoryItems += int64(s.store.HistoryLen())
+		st.HistoryBytes += s.store.HistoryBytes()
+		st.HistoryPromotions += s.store.Promotions()
+	}
+	return st
+}
+
+func (c *cache) remove(key string) {
+	c.shard(key).store.Remove(key)
+}
+
+// removeExpired drops expired entries, called periodically by the sweeper
+func (c *cache) removeExpired(now time.Time) int {
+	c.init()
+	n := 0
+	for _, s := range c.shards {
+		n += s.store.RemoveExpired(now)
+	}
+	return n
+}
+
+// items lists the entries and history of every shard, least recently used
+// first within each shard
+func (c *cache) items() []lru.Item {
+	c.init()
+	var items []lru.Item
+	for _, s := range c.shards {
+		items = append(items, s.store.Items()...)
+	}
+	return items
+}
+
+// restore puts items back into the shards owning them, keeping their order
+func (c *cache) restore(items []lru.Item) {
+	c.init()
+	byShard := make(map[*cacheShard][]lru.Item)
+	for _, item := range items {
+		s := c.shard(item.Key)
+		byShard[s] = append(byShard[s], item)
+	}
+	for s, items := range byShard {
+		s.store.Restore(items)
+	}
+}
+
+// lockedStore guards an lru.Cache, whose Get reorders entries, with a mutex
+type lockedStore struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+}
+
+func (s *lockedStore) Get(key string) (lru.Value, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Get(key)
+}
+
+func (s *lockedStore) AddWithExpire(key string, value lru.Value, expire time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.AddWithExpire(key, value, expire)
+}
+
+func (s *lockedStore) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.Remove(key)
+}
+
+func (s *lockedStore) RemoveExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.RemoveExpired(now)
+}
+
+func (s *lockedStore) GetNBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.GetNBytes()
+}
+
+func (s *lockedStore) GetMaxBytes() int64 {
+	return s.lru.GetMaxBytes()
+}
+
+func (s *lockedStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *lockedStore) Evictions() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Evictions()
+}
+
+func (s *lockedStore) HistoryLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.HistoryLen()
+}
+
+func (s *lockedStore) HistoryBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.HistoryBytes()
+}
+
+func (s *lockedStore) Promotions() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Promotions()
+}
+
+func (s *lockedStore) Items() []lru.Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Items()
+}
+
+func (s *lockedStore) Restore(items []lru.Item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.Restore(items)
+}
+
+// slabStore keeps the bytes of ByteViews in a slab.Cache. Segments are
+// written over once evicted, so the views it hands out, to onEvicted
+// too, hold copies.
+type slabStore struct {
+	*slab.Cache
+}
+
+func newSlabStore(maxBytes int64, onEvicted func(string, ByteView, lru.EvictReason)) *slabStore {
+	var f func(string, []byte, time.Time, lru.EvictReason)
+	if onEvicted != nil {
+		f = func(key string, value []byte, expire time.Time, reason lru.EvictReason) {
+			onEvicted(key, ByteView{b: cloneBytes(value), e: expire}, reason)
+		}
+	}
+	return &slabStore{slab.New(maxBytes, f)}
+}
+
+func (s *slabStore) Get(key string) (lru.Value, bool) {
+	b, e, ok := s.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return ByteView{b: b, e: e}, true
+}
+
+func (s *slabStore) AddWithExpire(key string, value lru.Value, expire time.Time) {
+	s.Cache.Add(key, value.(ByteView).b, expire)
+}
+
+// Items lists the records oldest first, slab.Cache evicts FIFO
+func (s *slabStore) Items() []lru.Item {
+	var items []lru.Item
+	s.Cache.Range(func(key string, value []byte, expire time.Time) bool {
+		items = append(items, lru.Item{Key: key, Value: ByteView{b: cloneBytes(value), e: expire}, Expire: expire})
+		return true
+	})
+	return items
+}
+
+func (s *slabStore) Restore(items []lru.Item) {
+	now := time.Now()
+	for _, item := range items {
+		if item.Value != nil && (item.Expire.IsZero() || now.Before(item.Expire)) {
+			s.Cache.Add(item.Key, item.Value.(ByteView).b, item.Expire)
+		}
+	}
+}
+
+func (s *slabStore) HistoryLen() int     { return 0 }
+func (s *slabStore) HistoryBytes() int64 { return 0 }
+func (s *slabStore) Promotions() int64   { return 0 }
+
+// CacheStats are returned by stats accessors on Group.
+type CacheStats struct {
+	Bytes             int64 `json:"bytes"`
+	MaxBytes          int64 `json:"max_bytes"`
+	Items             int64 `json:"items"`
+	Gets              int64 `json:"gets"`
+	Hits              int64 `json:"hits"`
+	Evictions         int64 `json:"evictions"`
+	HistoryItems      int64 `json:"history_items"`
+	HistoryBytes      int64 `json:"history_bytes"`
+	HistoryPromotions int64 `json:"history_promotions"`
+}
+
+// Misses returns how many lookups did not find a value
+func (s CacheStats) Misses() int64 {
+	return s.Gets - s.Hits
+}
@@ -2,6 +2,7 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 )
@@ -12,27 +13,50 @@ type Hash func(data []byte) uint32
 // Map contains all hashed keys
 type Map struct {
 	hash     Hash
-	replicas int            // 虚拟节点倍数
-	keys     []int          // Sorted，哈希环
-	hashMap  map[int]string // 虚拟节点与真实节点的映射表
+	replicas int                // 虚拟节点倍数
+	keys     []int              // Sorted，哈希环
+	hashMap  map[int]string     // 虚拟节点与真实节点的映射表
+	capacity map[string]float64 // 真实节点的容量系数，默认为 1
+	bounded  bool               // set by WithBoundedLoads
+	epsilon  float64
+}
+
+// Option configures a Map created with New
+type Option func(*Map)
+
+// WithBoundedLoads makes GetBounded keep the load of every item under
+// 1+epsilon times its share of the total load.
+func WithBoundedLoads(epsilon float64) Option {
+	return func(m *Map) {
+		m.bounded = true
+		m.epsilon = epsilon
+	}
 }
 
 // New creates a Map instance
-func New(replicas int, fn Hash) *Map {
+func New(replicas int, fn Hash, opts ...Option) *Map {
 	m := &Map{
 		replicas: replicas,
 		hash:     fn,
 		hashMap:  make(map[int]string),
+		capacity: make(map[string]float64),
 	}
 	if m.hash == nil {
 		m.hash = crc32.ChecksumIEEE
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
 	return m
 }
 
-// Add adds some keys to the hash.
+// Add adds some keys to the hash, with a capacity factor of 1 unless
+// SetCapacity gave them another one.
 func (m *Map) Add(keys ...string) {
 	for _, key := range keys {
+		if _, ok := m.capacity[key]; !ok {
+			m.capacity[key] = 1
+		}
 		for i := 0; i < m.replicas; i++ {
 			// 对每一个真实节点 key，对应创建 m.replicas 个虚拟节点
 			// 通过添加编号的方式区分不同虚拟节点
@@ -63,11 +87,113 @@ func (m *Map) Get(key string) string {
 	return m.hashMap[m.keys[idx%len(m.keys)]]
 }
 
+// GetFunc is like Get, but skips the items ok rejects and goes on
+// clockwise to the next one on the ring. Each item is asked at most once,
+// "" is returned when none is accepted.
+func (m *Map) GetFunc(key string, ok func(item string) bool) string {
+	if len(m.keys) == 0 {
+		return ""
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	var asked map[string]bool // allocated on the first rejection
+	for i := 0; i < len(m.keys); i++ {
+		item := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if asked[item] {
+			continue
+		}
+		if ok(item) {
+			return item
+		}
+		if asked == nil {
+			asked = make(map[string]bool)
+		}
+		asked[item] = true
+	}
+	return ""
+}
+
+// SetCapacity sets the capacity factor of a key added to the hash, e.g. 2
+// for a node that can serve twice the load of the others, or 0 for one
+// that should only get load when all the others are full. Only
+// GetBounded takes it into account.
+func (m *Map) SetCapacity(key string, factor float64) {
+	if _, ok := m.capacity[key]; ok {
+		m.capacity[key] = factor
+	}
+}
+
+// GetBounded is Get with consistent hashing with bounded loads (Mirrokni,
+// Thorup and Zadimoghaddam). load reports the current load of a key of
+// the hash, e.g. the requests it is serving. With a total load of T, an
+// item whose load has reached
+//
+//	ceil((1+epsilon) * (T+1) * capacity / total capacity)
+//
+// is skipped for the next one on the ring. The bounds add up to more than
+// T, so some item is always under its bound, and no item goes over it as
+// long as load counts what GetBounded assigns. Without WithBoundedLoads
+// it is the same as Get.
+func (m *Map) GetBounded(key string, load func(item string) int64) string {
+	if !m.bounded || len(m.keys) == 0 {
+		return m.Get(key)
+	}
+	loads := make(map[string]int64, len(m.capacity))
+	var total int64
+	var capacity float64
+	for item, c := range m.capacity {
+		loads[item] = load(item)
+		total += loads[item]
+		capacity += c
+	}
+	if capacity <= 0 {
+		return m.Get(key)
+	}
+	limit := (1 + m.epsilon) * float64(total+1) / capacity
+	if item := m.GetFunc(key, func(item string) bool {
+		return float64(loads[item]) < math.Ceil(limit*m.capacity[item])
+	}); item != "" {
+		return item
+	}
+	// only when load is not consistent with itself
+	return m.Get(key)
+}
+
+// Remove removes a key and its virtual nodes from the hash. Virtual
+// nodes of other keys that collided with them are left alone.
 func (m *Map) Remove(key string) {
+	delete(m.capacity, key)
 	for i := 0; i < m.replicas; i++ {
 		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		if m.hashMap[hash] != key {
+			continue
+		}
 		idx := sort.SearchInts(m.keys, hash)
 		m.keys = append(m.keys[:idx], m.keys[idx+1:]...)
 		delete(m.hashMap, hash)
 	}
 }
+
+// Clone returns a copy of m, so that keys can be added to or removed
+// from the copy while m is still read
+func (m *Map) Clone() *Map {
+	c := &Map{
+		hash:     m.hash,
+		replicas: m.replicas,
+		keys:     make([]int, len(m.keys)),
+		hashMap:  make(map[int]string, len(m.hashMap)),
+		capacity: make(map[string]float64, len(m.capacity)),
+		bounded:  m.bounded,
+		epsilon:  m.epsilon,
+	}
+	copy(c.keys, m.keys)
+	for hash, key := range m.hashMap {
+		c.hashMap[hash] = key
+	}
+	for key, factor := range m.capacity {
+		c.capacity[key] = factor
+	}
+	return c
+}
@@ -1,6 +1,7 @@
 package consistenthash
 
 import (
+	"math"
 	"strconv"
 	"testing"
 )
@@ -41,3 +42,183 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2")
+	clone := hash.Clone()
+
+	// 3, 13 and 23 move from 4 to the next replica, 6
+	clone.Remove("4")
+	for k, v := range map[string]string{"3": "6", "13": "6", "23": "6", "11": "2"} {
+		if clone.Get(k) != v {
+			t.Errorf("Asking for %s, should have yielded %s", k, v)
+		}
+	}
+	// the original is untouched
+	if hash.Get("3") != "4" {
+		t.Errorf("Remove on the clone changed the original")
+	}
+
+	clone.Remove("6")
+	clone.Remove("2")
+	if clone.Get("3") != "" {
+		t.Errorf("an empty hash should yield nothing")
+	}
+}
+
+func TestGetFunc(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2")
+
+	var asked []string
+	down := map[string]bool{"4": true}
+	ok := func(item string) bool {
+		asked = append(asked, item)
+		return !down[item]
+	}
+	// 23 belongs to 4, which is skipped for the next replica, 6
+	if got := hash.GetFunc("23", ok); got != "6" {
+		t.Errorf("Asking for 23, got %s, should have yielded 6", got)
+	}
+	if got := hash.GetFunc("11", ok); got != "2" {
+		t.Errorf("Asking for 11, got %s, should have yielded 2", got)
+	}
+
+	// 3 walks past 4 and 6 to 2
+	down["6"] = true
+	if got := hash.GetFunc("3", ok); got != "2" {
+		t.Errorf("Asking for 3, got %s, should have yielded 2", got)
+	}
+	// every replica is passed, but each item is asked once
+	down["2"] = true
+	asked = nil
+	if got := hash.GetFunc("3", ok); got != "" {
+		t.Errorf("Asking for 3 with every item down, got %s", got)
+	}
+	if len(asked) != 3 {
+		t.Errorf("asked %v, should have asked each item once", asked)
+	}
+}
+
+// assign gets the item of every key with GetBounded, counting the load
+// of each item, and checks that no item ever goes over its bound
+func assign(t *testing.T, hash *Map, epsilon float64, keys []string) map[string]int64 {
+	t.Helper()
+	loads := make(map[string]int64)
+	load := func(item string) int64 { return loads[item] }
+	var capacity float64
+	for _, c := range hash.capacity {
+		capacity += c
+	}
+	for i, key := range keys {
+		item := hash.GetBounded(key, load)
+		loads[item]++
+		total := float64(i + 1)
+		for item, l := range loads {
+			if bound := math.Ceil((1 + epsilon) * total * hash.capacity[item] / capacity); float64(l) > bound {
+				t.Fatalf("after %d keys %s has a load of %d, over its bound of %v", i+1, item, l, bound)
+			}
+		}
+	}
+	return loads
+}
+
+func TestBoundedLoads(t *testing.T) {
+	// with a single replica each, "1" owns 1 and everything past 3, so
+	// plain consistent hashing gives it almost every key
+	newMap := func(opts ...Option) *Map {
+		hash := New(1, func(key []byte) uint32 {
+			i, _ := strconv.Atoi(string(key))
+			return uint32(i)
+		}, opts...)
+		hash.Add("1", "2", "3")
+		return hash
+	}
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	loads := assign(t, newMap(), math.Inf(1), keys)
+	if loads["1"] != 98 {
+		t.Fatalf("without bounds 1 got %d keys, the test needs a skewed ring", loads["1"])
+	}
+
+	// ceil(1.1 * 100 / 3) = 37, the keys 1 can't take overflow to the
+	// next node on the ring, 2, then to 3
+	loads = assign(t, newMap(WithBoundedLoads(0.1)), 0.1, keys)
+	if loads["1"] != 37 || loads["2"] != 37 || loads["3"] != 26 {
+		t.Fatalf("got loads %v", loads)
+	}
+
+	// a capacity factor of 2 doubles the bound, ceil(1.25 * 100 * 2 / 4) = 63
+	// against ceil(1.25 * 100 / 4) = 32
+	hash := newMap(WithBoundedLoads(0.25))
+	hash.SetCapacity("1", 2)
+	loads = assign(t, hash, 0.25, keys)
+	if loads["1"] != 63 {
+		t.Fatalf("got loads %v", loads)
+	}
+
+	// a node with no capacity only gets keys once the others are full
+	hash = newMap(WithBoundedLoads(0))
+	hash.SetCapacity("3", 0)
+	loads = assign(t, hash, 0, keys)
+	if loads["3"] != 0 || loads["1"] != 50 || loads["2"] != 50 {
+		t.Fatalf("got loads %v", loads)
+	}
+}
+
+func TestBoundedLoadsRandom(t *testing.T) {
+	const n, m, epsilon = 10, 10000, 0.25
+	hash := New(50, nil, WithBoundedLoads(epsilon))
+	for i := 0; i < n; i++ {
+		hash.Add("node" + strconv.Itoa(i))
+	}
+	keys := make([]string, m)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	loads := assign(t, hash, epsilon, keys)
+	if len(loads) != n {
+		t.Fatalf("only %d nodes got keys", len(loads))
+	}
+
+	// under the bound GetBounded agrees with Get, so most keys stay with
+	// their owner
+	moved := 0
+	zero := func(string) int64 { return 0 }
+	for _, key := range keys {
+		if hash.GetBounded(key, zero) != hash.Get(key) {
+			t.Fatalf("%s moved although no node has any load", key)
+		}
+	}
+	loads = make(map[string]int64)
+	for _, key := range keys {
+		item := hash.GetBounded(key, func(item string) int64 { return loads[item] })
+		if item != hash.Get(key) {
+			moved++
+		}
+		loads[item]++
+	}
+	if moved > m/5 {
+		t.Fatalf("%d of %d keys moved off their owner", moved, m)
+	}
+
+	// without WithBoundedLoads it is plain Get
+	plain := hash.Clone()
+	plain.bounded = false
+	full := func(string) int64 { return m }
+	for _, key := range keys[:100] {
+		if plain.GetBounded(key, full) != hash.Get(key) {
+			t.Fatalf("GetBounded of %s differs from Get without bounds", key)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package ocache
+
+import (
+	"log"
+	"ocache/disk"
+	"sync"
+	"time"
+)
+
+// maxPendingDemotions is how many evicted values may wait to be written
+// to l2, more are dropped
+const maxPendingDemotions = 1024
+
+// demoter writes the values evicted from mainCache for lack of room to
+// l2 in the background. Evictions happen with a shard's lock held, which
+// is then not held across disk writes.
+type demoter struct {
+	l2   *disk.Cache
+	wake chan struct{} // signaled when pending is no longer empty
+
+	mu      sync.Mutex
+	pending map[string]ByteView // waiting for the writer
+	writing map[string]ByteView // taken by the writer, not all written yet
+
+	// writeMu is held across each write to l2 and by remove, so a value
+	// removed while it is being written does not come back
+	writeMu sync.Mutex
+	flushMu sync.Mutex // serializes flushes
+}
+
+func newDemoter(l2 *disk.Cache) *demoter {
+	return &demoter{
+		l2:      l2,
+		wake:    make(chan struct{}, 1),
+		pending: make(map[string]ByteView),
+	}
+}
+
+// add queues value to be written to l2, or drops it if too many are
+// already waiting. It does not block.
+func (d *demoter) add(key string, value ByteView) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pending[key]; !ok && len(d.pending) >= maxPendingDemotions {
+		return
+	}
+	d.pending[key] = value
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// get returns a value of key that is still waiting to be written
+func (d *demoter) get(key string) (ByteView, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	value, ok := d.pending[key]
+	if !ok {
+		value, ok = d.writing[key]
+	}
+	if !ok || (!value.e.IsZero() && time.Now().After(value.e)) {
+		return ByteView{}, false
+	}
+	return value, true
+}
+
+// remove drops key from l2 and from the values waiting to be written
+func (d *demoter) remove(key string) {
+	d.mu.Lock()
+	delete(d.pending, key)
+	delete(d.writing, key)
+	d.mu.Unlock()
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.l2.Remove(key)
+}
+
+// run writes the values queued by add until done is closed, then writes
+// the ones left
+func (d *demoter) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-d.wake:
+			d.flush()
+		case <-done:
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush writes the values waiting so far
+func (d *demoter) flush() {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+	d.mu.Lock()
+	batch := d.pending
+	d.pending = make(map[string]ByteView)
+	d.writing = batch
+	d.mu.Unlock()
+
+	for key := range batch {
+		d.writeMu.Lock()
+		d.mu.Lock()
+		value, ok := d.writing[key]
+		d.mu.Unlock()
+		if ok {
+			if err := d.l2.Add(key, value.b, value.e); err != nil {
+				log.Println("[oCache] Failed to demote", key, err)
+			}
+		}
+		d.writeMu.Unlock()
+	}
+
+	d.mu.Lock()
+	d.writing = nil
+	d.mu.Unlock()
+}
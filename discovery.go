@@ -0,0 +1,52 @@
+package ocache
+
+import (
+	"fmt"
+	"ocache/discovery"
+	"sync"
+)
+
+// Discover keeps the pool's peers in step with d: every list d finds
+// replaces the peers, as Set does, so it must name every node of the
+// group, this one included. A list without this node's base URL is
+// ignored, PickPeer could not tell the keys of this node from those of a
+// peer. Discover returns the error of d's first lookup, or an error and
+// stops d if the first list is ignored.
+func (p *HTTPPool) Discover(d discovery.Discovery) error {
+	var mu sync.Mutex
+	var first error
+	seen := false
+	err := d.Watch(func(peers []string) {
+		ok := hasPeer(peers, p.self)
+		mu.Lock()
+		if !seen && !ok {
+			first = fmt.Errorf("discovered peers %v do not include this node, %s", peers, p.self)
+		}
+		seen = true
+		mu.Unlock()
+		if !ok {
+			p.Log("ignoring discovered peers %v without this node", peers)
+			return
+		}
+		p.Set(peers...)
+	})
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	err = first
+	mu.Unlock()
+	if err != nil {
+		d.Stop()
+	}
+	return err
+}
+
+func hasPeer(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
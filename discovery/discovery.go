@@ -0,0 +1,194 @@
+// Package discovery finds the peers of a node from a list kept outside
+// of it, a file or DNS records, and watches the list for changes.
+package discovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discovery finds the peers of a node, every node of the group included.
+type Discovery interface {
+	// Watch calls update with the peers found, then with the whole new
+	// list each time it changes, until Stop is called. The first lookup
+	// happens before Watch returns, its error is returned and nothing is
+	// watched. Later errors are logged and the last list is kept, as it
+	// is when a lookup finds no peers at all after finding some.
+	Watch(update func(peers []string)) error
+	// Stop stops watching and waits for a running update to return.
+	Stop()
+}
+
+// poller runs lookup every interval and reports the peers it finds
+// whenever they change
+type poller struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+func (p *poller) watch(interval time.Duration, lookup func() ([]string, error), update func([]string)) error {
+	peers, err := lookup()
+	if err != nil {
+		return err
+	}
+	peers = normalize(peers)
+	update(peers)
+
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+			}
+			next, err := lookup()
+			if err != nil {
+				log.Println("[discovery] lookup:", err)
+				continue
+			}
+			next = normalize(next)
+			if len(next) == 0 && len(peers) > 0 {
+				log.Println("[discovery] lookup found no peers, keeping the last ones")
+				continue
+			}
+			if !equal(peers, next) {
+				peers = next
+				update(peers)
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *poller) stop() {
+	if p.done == nil {
+		return
+	}
+	p.once.Do(func() { close(p.done) })
+	p.wg.Wait()
+}
+
+// normalize sorts peers and drops the duplicates
+func normalize(peers []string) []string {
+	sort.Strings(peers)
+	out := peers[:0]
+	for i, peer := range peers {
+		if i == 0 || peer != peers[i-1] {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// File reads the peers from a file, one or more per line separated by
+// spaces. Blank lines and everything after a # are ignored:
+//
+//	# cache nodes
+//	http://10.0.0.1:8001
+//	http://10.0.0.2:8001
+//
+// The file is checked every Interval and read again when its size or
+// modification time changed. It should be replaced by writing a
+// temporary file and renaming it over the old one: a read that sees the
+// file change under it is retried, but a rewrite in place can still be
+// seen half done if its size and modification time settle in between.
+type File struct {
+	Path     string
+	Interval time.Duration // 1s by default
+
+	modTime time.Time
+	size    int64
+	peers   []string
+	poller
+}
+
+// NewFile returns a File reading path.
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// Watch implements Discovery.
+func (f *File) Watch(update func(peers []string)) error {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return f.watch(interval, f.lookup, update)
+}
+
+// Stop implements Discovery.
+func (f *File) Stop() {
+	f.stop()
+}
+
+// errChanging is returned by File.lookup when the file keeps changing
+// while it is read
+var errChanging = errors.New("discovery: peers file changed while read")
+
+// readAttempts is how many times File.lookup reads a file that changes
+// under it before giving up until the next check
+const readAttempts = 3
+
+func (f *File) lookup() ([]string, error) {
+	for i := 0; i < readAttempts; i++ {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if f.peers != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+			return append([]string(nil), f.peers...), nil
+		}
+		b, err := ioutil.ReadFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		// drop a read that raced with a write
+		after, err := os.Stat(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) != info.Size() || after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		peers := parse(string(b))
+		f.modTime, f.size, f.peers = info.ModTime(), info.Size(), peers
+		return append([]string(nil), peers...), nil
+	}
+	return nil, errChanging
+}
+
+// parse returns the peers listed in a peers file
+func parse(s string) []string {
+	peers := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		peers = append(peers, strings.Fields(line)...)
+	}
+	return peers
+}
@@ -0,0 +1,225 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// updates records the lists passed to update
+type updates struct {
+	mu    sync.Mutex
+	lists [][]string
+}
+
+func (u *updates) update(peers []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lists = append(u.lists, peers)
+}
+
+func (u *updates) get() [][]string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([][]string(nil), u.lists...)
+}
+
+// eventually fails the test unless u gets want within a few seconds
+func (u *updates) eventually(t *testing.T, want ...[]string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(u.get(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got updates %v, want %v", u.get(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParse(t *testing.T) {
+	peers := parse("# nodes\nhttp://b:8001  http://a:8001\n\n  http://c:8001 # the new one\n")
+	if want := []string{"http://b:8001", "http://a:8001", "http://c:8001"}; !reflect.DeepEqual(peers, want) {
+		t.Fatalf("got %v, want %v", peers, want)
+	}
+	if peers := parse("# none yet\n"); peers == nil || len(peers) != 0 {
+		t.Fatalf("got %#v, want an empty list", peers)
+	}
+	if peers := normalize([]string{"b", "a", "b", "c", "a"}); !reflect.DeepEqual(peers, []string{"a", "b", "c"}) {
+		t.Fatalf("normalize got %v", peers)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers")
+	// every write replaces the file with a renamed temporary one, with a
+	// later modification time, the file system may not tell writes apart
+	// within the same second
+	mtime := time.Now()
+	write := func(s string) {
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := NewFile(path)
+	f.Interval = 10 * time.Millisecond
+	var u updates
+	if err := f.Watch(u.update); !os.IsNotExist(err) {
+		t.Fatalf("watching a missing file got %v", err)
+	}
+
+	write("http://b:8001\nhttp://a:8001\n")
+	f = NewFile(path)
+	f.Interval = 10 * time.Millisecond
+	if err := f.Watch(u.update); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	first := []string{"http://a:8001", "http://b:8001"}
+	u.eventually(t, first)
+
+	// same peers in another order, nothing to report
+	write("http://a:8001 http://b:8001 # reordered\n")
+	time.Sleep(50 * time.Millisecond)
+	u.eventually(t, first)
+
+	write("http://a:8001\nhttp://c:8001\n")
+	second := []string{"http://a:8001", "http://c:8001"}
+	u.eventually(t, first, second)
+
+	// an empty file keeps the last list
+	write("# nobody\n")
+	time.Sleep(50 * time.Millisecond)
+	u.eventually(t, first, second)
+
+	// a missing file keeps the last list
+	os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	u.eventually(t, first, second)
+
+	write("http://c:8001\n")
+	u.eventually(t, first, second, []string{"http://c:8001"})
+
+	f.Stop()
+	write("http://d:8001\n")
+	time.Sleep(50 * time.Millisecond)
+	if n := len(u.get()); n != 3 {
+		t.Fatalf("got %d updates after Stop", n-3)
+	}
+}
+
+// fakeResolver answers from its maps, or fails with err
+type fakeResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) set(hosts map[string][]string, srvs map[string][]*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts, r.srvs, r.err = hosts, srvs, err
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return append([]string(nil), addrs...), nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	cname := "_" + service + "._" + proto + "." + name
+	srvs, ok := r.srvs[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, append([]*net.SRV(nil), srvs...), nil
+}
+
+func TestDNS(t *testing.T) {
+	r := &fakeResolver{}
+	r.set(map[string][]string{"ocache.local": {"10.0.0.2", "10.0.0.1", "::1"}}, nil, nil)
+	d := NewDNS("ocache.local", 8001)
+	d.Interval = 10 * time.Millisecond
+	d.Resolver = r
+	var u updates
+	if err := d.Watch(u.update); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	first := []string{"http://10.0.0.1:8001", "http://10.0.0.2:8001", "http://[::1]:8001"}
+	u.eventually(t, first)
+
+	// failures keep the last list
+	r.set(nil, nil, errors.New("timeout"))
+	time.Sleep(50 * time.Millisecond)
+	u.eventually(t, first)
+
+	r.set(map[string][]string{"ocache.local": {"10.0.0.1", "10.0.0.3"}}, nil, nil)
+	u.eventually(t, first, []string{"http://10.0.0.1:8001", "http://10.0.0.3:8001"})
+}
+
+func TestDNSSRV(t *testing.T) {
+	r := &fakeResolver{}
+	d := NewDNSSRV("ocache", "tcp", "example.com")
+	d.Scheme = "https"
+	d.Interval = 10 * time.Millisecond
+	d.Resolver = r
+	var u updates
+	if err := d.Watch(u.update); err == nil {
+		t.Fatal("watching a missing record got no error")
+	}
+
+	r.set(nil, map[string][]*net.SRV{"_ocache._tcp.example.com": {
+		{Target: "b.example.com.", Port: 8002},
+		{Target: "a.example.com.", Port: 8001},
+	}}, nil)
+	d = NewDNSSRV("ocache", "tcp", "example.com")
+	d.Scheme = "https"
+	d.Interval = 10 * time.Millisecond
+	d.Resolver = r
+	if err := d.Watch(u.update); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	first := []string{"https://a.example.com:8001", "https://b.example.com:8002"}
+	u.eventually(t, first)
+
+	r.set(nil, map[string][]*net.SRV{"_ocache._tcp.example.com": {
+		{Target: "a.example.com.", Port: 8001},
+	}}, nil)
+	u.eventually(t, first, []string{"https://a.example.com:8001"})
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up DNS records. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNS finds the peers in DNS, looked up again every Interval. With
+// Service set it looks up the SRV records _Service._Proto.Name and takes
+// the port of each target from its record, otherwise it looks up the A
+// and AAAA records of Name and uses Port. The peers are base URLs such as
+// "http://10.0.0.1:8001", as HTTPPool expects.
+type DNS struct {
+	Name     string
+	Service  string
+	Proto    string // "tcp" by default
+	Port     int
+	Scheme   string        // "http" by default
+	Interval time.Duration // 10s by default, also the timeout of a lookup
+	Resolver Resolver      // net.DefaultResolver by default
+
+	poller
+}
+
+// NewDNS returns a DNS looking up the A and AAAA records of host, for
+// peers listening on port.
+func NewDNS(host string, port int) *DNS {
+	return &DNS{Name: host, Port: port}
+}
+
+// NewDNSSRV returns a DNS looking up the SRV records _service._proto.name.
+func NewDNSSRV(service, proto, name string) *DNS {
+	return &DNS{Name: name, Service: service, Proto: proto}
+}
+
+// Watch implements Discovery.
+func (d *DNS) Watch(update func(peers []string)) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return d.watch(interval, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		return d.lookup(ctx)
+	}, update)
+}
+
+// Stop implements Discovery.
+func (d *DNS) Stop() {
+	d.stop()
+}
+
+func (d *DNS) lookup(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var peers []string
+	if d.Service != "" {
+		proto := d.Proto
+		if proto == "" {
+			proto = "tcp"
+		}
+		_, srvs, err := resolver.LookupSRV(ctx, d.Service, proto, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			peers = append(peers, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return peers, nil
+	}
+
+	hosts, err := resolver.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		peers = append(peers, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(d.Port)))
+	}
+	return peers, nil
+}
@@ -0,0 +1,310 @@
+package disk
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache keeps values in files of a local directory, one file per key,
+// bounded by maxBytes and evicted in LRU order. It survives restarts: Open
+// indexes the files left by a previous run, in the order they were written.
+//
+// A file is written to a temporary name and renamed into place, so a
+// crash leaves either the old file or the new one. Every file carries a
+// CRC-32C of its content which is verified on Get, a corrupted file is
+// deleted and reported as a miss.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu     sync.Mutex
+	ll     *list.List               // most recently used at front
+	items  map[string]*list.Element // file name -> element of ll
+	nbytes int64                    // size of the indexed files
+	nevict int64
+}
+
+// file is an indexed file of the cache
+type file struct {
+	name string
+	size int64
+}
+
+const (
+	magic = "OCD1"
+	// headerSize is the magic, the checksum, the expire in unix
+	// nanoseconds, the key length and the value length
+	headerSize = 4 + 4 + 8 + 4 + 4
+	tmpSuffix  = ".tmp"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt is returned by decode for a file that fails the checks
+var errCorrupt = errors.New("disk: corrupted file")
+
+// Open indexes the cache files in dir, creating it if needed. Files that
+// are truncated, expired or left half written by a crash are deleted.
+// maxBytes 0 means no limit, otherwise the oldest files are evicted until
+// the rest fit.
+func Open(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	// oldest first, so the most recently written ends up in front
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	now := time.Now()
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		if filepath.Ext(name) == tmpSuffix {
+			os.Remove(path)
+			continue
+		}
+		if info.IsDir() || !validName(name) {
+			continue
+		}
+		if !checkHeader(path, info.Size(), now) {
+			os.Remove(path)
+			continue
+		}
+		c.items[name] = c.ll.PushFront(&file{name: name, size: info.Size()})
+		c.nbytes += info.Size()
+	}
+	c.mu.Lock()
+	c.shrink()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// checkHeader tells if the file at path is complete and not expired,
+// without reading the value
+func checkHeader(path string, size int64, now time.Time) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var h [headerSize]byte
+	if _, err := io.ReadFull(f, h[:]); err != nil || string(h[:4]) != magic {
+		return false
+	}
+	expire, klen, vlen := parseHeader(h[:])
+	if size != headerSize+int64(klen)+int64(vlen) {
+		return false
+	}
+	return expire.IsZero() || now.Before(expire)
+}
+
+func parseHeader(h []byte) (expire time.Time, klen, vlen uint32) {
+	if n := int64(binary.LittleEndian.Uint64(h[8:])); n != 0 {
+		expire = time.Unix(0, n)
+	}
+	return expire, binary.LittleEndian.Uint32(h[16:]), binary.LittleEndian.Uint32(h[20:])
+}
+
+// fileName returns the name of the file of key, the hex FNV-1a hash of
+// the key. Keys with colliding hashes replace each other.
+func fileName(key string) string {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], h)
+	return hex.EncodeToString(b[:])
+}
+
+func validName(name string) bool {
+	if len(name) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func encode(key string, value []byte, expire time.Time) []byte {
+	b := make([]byte, headerSize+len(key)+len(value))
+	copy(b, magic)
+	var n int64
+	if !expire.IsZero() {
+		n = expire.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(b[8:], uint64(n))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(value)))
+	copy(b[headerSize:], key)
+	copy(b[headerSize+len(key):], value)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b[8:], castagnoli))
+	return b
+}
+
+func decode(b []byte) (key string, value []byte, expire time.Time, err error) {
+	if len(b) < headerSize || string(b[:4]) != magic {
+		return "", nil, time.Time{}, errCorrupt
+	}
+	if binary.LittleEndian.Uint32(b[4:]) != crc32.Checksum(b[8:], castagnoli) {
+		return "", nil, time.Time{}, errCorrupt
+	}
+	expire, klen, vlen := parseHeader(b)
+	if int64(len(b)) != headerSize+int64(klen)+int64(vlen) {
+		return "", nil, time.Time{}, errCorrupt
+	}
+	key = string(b[headerSize : headerSize+klen])
+	return key, b[headerSize+klen:], expire, nil
+}
+
+// Add writes value for key, to be dropped once expire has passed, a zero
+// expire means never. A value larger than maxBytes is not stored.
+func (c *Cache) Add(key string, value []byte, expire time.Time) error {
+	b := encode(key, value, expire)
+	size := int64(len(b))
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return nil
+	}
+	name := fileName(key)
+	tmp, err := ioutil.TempFile(c.dir, name+".*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.items[name]; ok {
+		f := ele.Value.(*file)
+		c.nbytes += size - f.size
+		f.size = size
+		c.ll.MoveToFront(ele)
+	} else {
+		c.items[name] = c.ll.PushFront(&file{name: name, size: size})
+		c.nbytes += size
+	}
+	c.shrink()
+	return nil
+}
+
+// shrink deletes the least recently used files while over maxBytes,
+// c.mu must be held
+func (c *Cache) shrink() {
+	for c.maxBytes > 0 && c.nbytes > c.maxBytes {
+		ele := c.ll.Back()
+		if ele == nil {
+			return
+		}
+		c.removeElement(ele)
+		c.nevict++
+	}
+}
+
+// removeElement deletes the file of ele, c.mu must be held
+func (c *Cache) removeElement(ele *list.Element) {
+	f := ele.Value.(*file)
+	c.ll.Remove(ele)
+	delete(c.items, f.name)
+	c.nbytes -= f.size
+	os.Remove(filepath.Join(c.dir, f.name))
+}
+
+// Get reads the value of key and its deadline. A file that is corrupted
+// or expired is deleted.
+func (c *Cache) Get(key string) (value []byte, expire time.Time, ok bool) {
+	name := fileName(key)
+	c.mu.Lock()
+	ele, ok := c.items[name]
+	if ok {
+		c.ll.MoveToFront(ele)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		// deleted by a concurrent Remove or eviction
+		return nil, time.Time{}, false
+	}
+	k, value, expire, err := decode(b)
+	if err == nil && k != key {
+		// a colliding key owns the file
+		return nil, time.Time{}, false
+	}
+	if err != nil || !expire.IsZero() && time.Now().After(expire) {
+		c.mu.Lock()
+		if ele, ok := c.items[name]; ok && ele.Value.(*file).size == int64(len(b)) {
+			c.removeElement(ele)
+		}
+		c.mu.Unlock()
+		return nil, time.Time{}, false
+	}
+	return value, expire, true
+}
+
+// Remove deletes the file of key
+func (c *Cache) Remove(key string) {
+	name := fileName(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.items[name]; ok {
+		c.removeElement(ele)
+	}
+}
+
+// Len returns the number of files in the cache
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Bytes returns the size of the files in the cache
+func (c *Cache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nbytes
+}
+
+func (c *Cache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+// Evictions returns how many files were deleted to stay within maxBytes
+func (c *Cache) Evictions() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nevict
+}
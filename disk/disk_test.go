@@ -0,0 +1,152 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ocache-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestGet(t *testing.T) {
+	c, err := Open(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("key1", []byte("1234"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, _, ok := c.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+	c.Add("key1", []byte("5678"), time.Time{})
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "5678" {
+		t.Fatalf("overwrite key1=5678 failed")
+	}
+	if c.Len() != 1 || c.Bytes() != headerSize+4+4 {
+		t.Fatalf("len %d, bytes %d", c.Len(), c.Bytes())
+	}
+	c.Remove("key1")
+	if _, _, ok := c.Get("key1"); ok || c.Len() != 0 || c.Bytes() != 0 {
+		t.Fatalf("key1 should be removed")
+	}
+}
+
+func TestEvict(t *testing.T) {
+	size := int64(headerSize + 2 + 10)
+	c, err := Open(tempDir(t), 3*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 13; i++ {
+		c.Add(strconv.Itoa(i), []byte("0123456789"), time.Time{})
+	}
+	c.Get("10")
+	c.Add("13", []byte("0123456789"), time.Time{})
+	if _, _, ok := c.Get("11"); ok {
+		t.Fatalf("least recently used 11 should be evicted")
+	}
+	for _, key := range []string{"10", "12", "13"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Fatalf("%s should be cached", key)
+		}
+	}
+	if c.Evictions() != 1 || c.Bytes() != 3*size {
+		t.Fatalf("evictions %d, bytes %d", c.Evictions(), c.Bytes())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	c, err := Open(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(20 * time.Millisecond)
+	c.Add("key", []byte("value"), deadline)
+	if _, e, ok := c.Get("key"); !ok || !e.Equal(deadline) {
+		t.Fatalf("key should not have expired, deadline %v", e)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := c.Get("key"); ok || c.Len() != 0 {
+		t.Fatalf("key should have expired")
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	dir := tempDir(t)
+	c, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add("key", []byte("value"), time.Time{})
+	path := filepath.Join(dir, fileName("key"))
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)-1] ^= 1
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get("key"); ok {
+		t.Fatalf("corrupted value should not be returned")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || c.Len() != 0 {
+		t.Fatalf("corrupted file should be deleted")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir := tempDir(t)
+	c, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		key := strconv.Itoa(i)
+		c.Add(key, []byte("value"+key), time.Time{})
+		// the modification times give the recency order back
+		mtime := start.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(filepath.Join(dir, fileName(key)), mtime, mtime)
+	}
+	c.Add("expired", []byte("value"), time.Now().Add(time.Millisecond))
+	// a truncated file and a write interrupted by a crash
+	truncated := filepath.Join(dir, fileName("4"))
+	b, _ := ioutil.ReadFile(truncated)
+	ioutil.WriteFile(truncated, b[:len(b)-1], 0644)
+	ioutil.WriteFile(filepath.Join(dir, fileName("5")+".123"+tmpSuffix), b, 0644)
+	time.Sleep(5 * time.Millisecond)
+
+	// keep room for three of the four good files
+	size := int64(headerSize + 1 + 6)
+	c, err = Open(dir, 3*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get("0"); ok {
+		t.Fatalf("the oldest file should be evicted on recovery")
+	}
+	for i := 1; i < 4; i++ {
+		if v, _, ok := c.Get(strconv.Itoa(i)); !ok || string(v) != "value"+strconv.Itoa(i) {
+			t.Fatalf("%d should be recovered", i)
+		}
+	}
+	if _, _, ok := c.Get("4"); ok {
+		t.Fatalf("truncated file should not be recovered")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 3 || c.Len() != 3 {
+		t.Fatalf("%d files left, %d indexed", len(files), c.Len())
+	}
+}
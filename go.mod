@@ -4,5 +4,6 @@ go 1.15
 
 require (
 	github.com/golang/protobuf v1.5.2
+	google.golang.org/grpc v1.41.0
 	google.golang.org/protobuf v1.27.1
 )
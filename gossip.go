@@ -0,0 +1,27 @@
+package ocache
+
+import "ocache/gossip"
+
+// StartGossip starts a gossip member named after this pool's address,
+// and from then on keeps the pool's peers in step with the members that
+// are alive: AddPeers when one joins, RemovePeers when one dies or leaves.
+// cfg.Name is set to the pool's address, cfg.OnJoin and cfg.OnLeave are
+// still called if set.
+func (p *HTTPPool) StartGossip(cfg gossip.Config) (*gossip.Node, error) {
+	cfg.Name = p.self
+	onJoin, onLeave := cfg.OnJoin, cfg.OnLeave
+	cfg.OnJoin = func(name string) {
+		p.AddPeers(name)
+		if onJoin != nil {
+			onJoin(name)
+		}
+	}
+	cfg.OnLeave = func(name string) {
+		p.RemovePeers(name)
+		if onLeave != nil {
+			onLeave(name)
+		}
+	}
+	p.AddPeers(p.self)
+	return gossip.Start(cfg)
+}
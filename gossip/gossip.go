@@ -0,0 +1,626 @@
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/bits"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Node is a member of a SWIM-style gossip group (Das, Gupta and
+// Motivala). Every ProbeInterval it pings one member, in a shuffled round
+// robin. When no ack comes back within ProbeTimeout it asks IndirectChecks
+// other members to ping it on its behalf, and if none of them gets an ack
+// either the member is suspected. A suspect that does not refute the
+// suspicion, by gossiping a higher incarnation, within SuspicionTimeout is
+// declared dead.
+//
+// Membership updates are piggybacked on the protocol messages, each sent
+// a few times, O(log n), before it is dropped. Every PushPullInterval a
+// node also exchanges its full state with a random member or seed, which
+// brings new members up to date and merges the two sides of a healed
+// partition. Dead members are part of that state for DeadRetention, then
+// forgotten.
+type Node struct {
+	cfg  Config
+	conn *net.UDPConn
+	addr string // advertised UDP address
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*member // by name, dead ones included, self excluded
+	order       []string           // probe order
+	next        int                // position in order
+	seq         uint64
+	acks        map[uint64]func() // handlers of expected acks by seq
+	queue       []*broadcast      // updates waiting to be piggybacked
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Config configures a Node started with Start.
+type Config struct {
+	// Name identifies the node, e.g. the base URL of its HTTPPool.
+	Name string
+	// BindAddr is the UDP address to listen on, e.g. "10.0.0.1:7946".
+	BindAddr string
+	// AdvertiseAddr is the UDP address other members reach the node
+	// at, the address BindAddr resolved to by default.
+	AdvertiseAddr string
+	// Seeds are UDP addresses of members to join through.
+	Seeds []string
+
+	ProbeInterval    time.Duration // 1s by default
+	ProbeTimeout     time.Duration // ProbeInterval/3 by default
+	IndirectChecks   int           // 3 by default
+	SuspicionTimeout time.Duration // 5 ProbeIntervals by default
+	PushPullInterval time.Duration // 30 ProbeIntervals by default
+	// DeadRetention is how long a dead member is kept, and gossiped as
+	// dead in push-pull exchanges, before it is forgotten. 10
+	// SuspicionTimeouts by default.
+	DeadRetention time.Duration
+
+	// OnJoin and OnLeave are called when a member becomes alive and
+	// when it is declared dead or leaves. They are called in order, with
+	// the Node's lock held, and must not call the Node.
+	OnJoin  func(name string)
+	OnLeave func(name string)
+}
+
+// State is the state of a member as seen by a Node.
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member describes a member of the group.
+type Member struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// member is a Member known to a Node
+type member struct {
+	Member
+	suspicion *time.Timer // running while suspect
+	died      time.Time   // when it was found dead, while dead
+}
+
+// broadcast is an update and how many more times it is piggybacked
+type broadcast struct {
+	m         Member
+	transmits int
+}
+
+type msgType int
+
+const (
+	msgPing msgType = iota
+	msgAck
+	msgPingReq       // ping Target and forward its ack
+	msgPushPull      // here is my state, send me yours
+	msgPushPullReply // here is mine
+)
+
+// message is the JSON form of every packet
+type message struct {
+	Type    msgType  `json:"t"`
+	Seq     uint64   `json:"s,omitempty"`
+	Target  string   `json:"a,omitempty"`
+	Updates []Member `json:"u,omitempty"`
+}
+
+const (
+	maxPacketSize    = 64 << 10
+	maxPiggyback     = 16 // updates piggybacked on a message
+	retransmitFactor = 3  // an update is sent retransmitFactor*log2(n) times
+)
+
+// Start listens on cfg.BindAddr and joins the members at cfg.Seeds.
+// Seeds that do not answer are tried again until one does, so members
+// may be started in any order.
+func Start(cfg Config) (*Node, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("gossip: a name is required")
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = cfg.ProbeInterval / 3
+	}
+	if cfg.IndirectChecks <= 0 {
+		cfg.IndirectChecks = 3
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = 5 * cfg.ProbeInterval
+	}
+	if cfg.PushPullInterval <= 0 {
+		cfg.PushPullInterval = 30 * cfg.ProbeInterval
+	}
+	if cfg.DeadRetention <= 0 {
+		cfg.DeadRetention = 10 * cfg.SuspicionTimeout
+	}
+	laddr, err := net.ResolveUDPAddr("udp", cfg.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:     cfg,
+		conn:    conn,
+		addr:    cfg.AdvertiseAddr,
+		members: make(map[string]*member),
+		acks:    make(map[uint64]func()),
+		done:    make(chan struct{}),
+	}
+	if n.addr == "" {
+		n.addr = conn.LocalAddr().String()
+	}
+	n.wg.Add(2)
+	go n.receive()
+	go n.run()
+	n.pushPull(cfg.Seeds...)
+	return n, nil
+}
+
+// Addr returns the UDP address the node is reached at
+func (n *Node) Addr() string {
+	return n.addr
+}
+
+// Members returns the members that are not dead, the node included,
+// sorted by name
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := []Member{n.self()}
+	for _, m := range n.members {
+		if m.State != StateDead {
+			members = append(members, m.Member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// self returns the node as a Member, n.mu must be held
+func (n *Node) self() Member {
+	return Member{Name: n.cfg.Name, Addr: n.addr, State: StateAlive, Incarnation: n.incarnation}
+}
+
+// Leave tells the other members the node is leaving, so they drop it
+// right away instead of after SuspicionTimeout, then closes it.
+func (n *Node) Leave() error {
+	n.mu.Lock()
+	self := n.self()
+	self.State = StateDead
+	var addrs []string
+	for _, m := range n.members {
+		if m.State != StateDead {
+			addrs = append(addrs, m.Addr)
+		}
+	}
+	n.mu.Unlock()
+	for _, addr := range addrs {
+		n.sendRaw(addr, message{Type: msgAck, Updates: []Member{self}})
+	}
+	return n.Close()
+}
+
+// Close stops the node without telling the other members, which will
+// find it dead.
+func (n *Node) Close() error {
+	select {
+	case <-n.done:
+		return nil
+	default:
+	}
+	close(n.done)
+	err := n.conn.Close()
+	n.wg.Wait()
+	n.mu.Lock()
+	for _, m := range n.members {
+		if m.suspicion != nil {
+			m.suspicion.Stop()
+		}
+	}
+	n.mu.Unlock()
+	return err
+}
+
+// run probes a member every ProbeInterval, forgetting the members dead
+// for longer than DeadRetention, and exchanges state every
+// PushPullInterval
+func (n *Node) run() {
+	defer n.wg.Done()
+	probe := time.NewTicker(n.cfg.ProbeInterval)
+	defer probe.Stop()
+	pushPull := time.NewTicker(n.cfg.PushPullInterval)
+	defer pushPull.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-probe.C:
+			n.reap(time.Now())
+			n.probe()
+		case <-pushPull.C:
+			n.pushPullRandom()
+		}
+	}
+}
+
+// probe pings the next member, directly and then through others
+func (n *Node) probe() {
+	n.mu.Lock()
+	target, ok := n.nextTarget()
+	if !ok {
+		n.mu.Unlock()
+		// alone, e.g. the seeds were not up yet
+		n.pushPull(n.cfg.Seeds...)
+		return
+	}
+	acked := make(chan struct{}, 1)
+	seq := n.expectAck(func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	})
+	n.mu.Unlock()
+	defer n.forgetAck(seq)
+
+	n.send(target.Addr, message{Type: msgPing, Seq: seq})
+	timeout := time.NewTimer(n.cfg.ProbeTimeout)
+	defer timeout.Stop()
+	select {
+	case <-acked:
+		return
+	case <-n.done:
+		return
+	case <-timeout.C:
+	}
+
+	n.mu.Lock()
+	helpers := n.randomMembers(n.cfg.IndirectChecks, target.Name)
+	n.mu.Unlock()
+	for _, m := range helpers {
+		n.send(m.Addr, message{Type: msgPingReq, Seq: seq, Target: target.Addr})
+	}
+	timeout.Reset(n.cfg.ProbeInterval - n.cfg.ProbeTimeout)
+	select {
+	case <-acked:
+		return
+	case <-n.done:
+		return
+	case <-timeout.C:
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m, ok := n.members[target.Name]; ok && m.State == StateAlive && m.Incarnation == target.Incarnation {
+		n.merge(Member{Name: m.Name, Addr: m.Addr, State: StateSuspect, Incarnation: m.Incarnation})
+	}
+}
+
+// reap forgets the members dead for longer than DeadRetention
+func (n *Node) reap(now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for name, m := range n.members {
+		if m.State == StateDead && now.Sub(m.died) > n.cfg.DeadRetention {
+			delete(n.members, name)
+		}
+	}
+}
+
+// nextTarget returns the next member to probe, reshuffling the order
+// after each round, n.mu must be held
+func (n *Node) nextTarget() (Member, bool) {
+	for tries := 0; tries <= len(n.order); tries++ {
+		if n.next >= len(n.order) {
+			n.order = n.order[:0]
+			for name, m := range n.members {
+				if m.State != StateDead {
+					n.order = append(n.order, name)
+				}
+			}
+			rand.Shuffle(len(n.order), func(i, j int) { n.order[i], n.order[j] = n.order[j], n.order[i] })
+			n.next = 0
+			if len(n.order) == 0 {
+				return Member{}, false
+			}
+		}
+		m, ok := n.members[n.order[n.next]]
+		n.next++
+		if ok && m.State != StateDead {
+			return m.Member, true
+		}
+	}
+	return Member{}, false
+}
+
+// randomMembers returns up to k members that are alive, other than
+// except, n.mu must be held
+func (n *Node) randomMembers(k int, except string) []Member {
+	var members []Member
+	for name, m := range n.members {
+		if name != except && m.State == StateAlive {
+			members = append(members, m.Member)
+		}
+	}
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	if len(members) > k {
+		members = members[:k]
+	}
+	return members
+}
+
+// expectAck registers fn to run when the ack of the returned seq
+// arrives, n.mu must be held
+func (n *Node) expectAck(fn func()) uint64 {
+	n.seq++
+	n.acks[n.seq] = fn
+	return n.seq
+}
+
+func (n *Node) forgetAck(seq uint64) {
+	n.mu.Lock()
+	delete(n.acks, seq)
+	n.mu.Unlock()
+}
+
+// pushPullRandom exchanges state with a random member, dead ones
+// included since they may be back, or a seed
+func (n *Node) pushPullRandom() {
+	n.mu.Lock()
+	addrs := append([]string(nil), n.cfg.Seeds...)
+	for _, m := range n.members {
+		addrs = append(addrs, m.Addr)
+	}
+	n.mu.Unlock()
+	if len(addrs) > 0 {
+		n.pushPull(addrs[rand.Intn(len(addrs))])
+	}
+}
+
+// pushPull sends the full state of the node to addrs
+func (n *Node) pushPull(addrs ...string) {
+	for _, addr := range addrs {
+		if addr != n.addr {
+			n.sendRaw(addr, message{Type: msgPushPull, Updates: n.state()})
+		}
+	}
+}
+
+// state returns every member known, dead ones included, and the node
+func (n *Node) state() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	state := []Member{n.self()}
+	for _, m := range n.members {
+		state = append(state, m.Member)
+	}
+	return state
+}
+
+// receive handles packets until the node is closed
+func (n *Node) receive() {
+	defer n.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+			}
+			log.Println("[gossip] read:", err)
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(buf[:size], &msg); err != nil {
+			log.Println("[gossip] bad packet from", from, err)
+			continue
+		}
+		n.handle(from.String(), msg)
+	}
+}
+
+func (n *Node) handle(from string, msg message) {
+	n.mu.Lock()
+	for _, u := range msg.Updates {
+		n.merge(u)
+	}
+	var ack func()
+	if msg.Type == msgAck {
+		ack = n.acks[msg.Seq]
+	}
+	n.mu.Unlock()
+
+	switch msg.Type {
+	case msgPing:
+		n.send(from, message{Type: msgAck, Seq: msg.Seq})
+	case msgAck:
+		if ack != nil {
+			ack()
+		}
+	case msgPingReq:
+		n.mu.Lock()
+		seq := n.expectAck(func() {
+			n.send(from, message{Type: msgAck, Seq: msg.Seq})
+		})
+		n.mu.Unlock()
+		time.AfterFunc(n.cfg.ProbeInterval, func() { n.forgetAck(seq) })
+		n.send(msg.Target, message{Type: msgPing, Seq: seq})
+	case msgPushPull:
+		n.sendRaw(from, message{Type: msgPushPullReply, Updates: n.state()})
+	}
+}
+
+// merge applies an update to the membership, keeping it if it is newer
+// than what the node knows, and gossips it further, n.mu must be held.
+// Alive overrides a lower incarnation, suspect overrides alive with the
+// same incarnation, dead overrides both.
+func (n *Node) merge(u Member) {
+	if u.Name == n.cfg.Name {
+		if u.State != StateAlive && u.Incarnation >= n.incarnation {
+			// refute the rumor of our death
+			n.incarnation = u.Incarnation + 1
+			n.enqueue(n.self())
+		}
+		return
+	}
+	m, ok := n.members[u.Name]
+	if !ok {
+		if u.State == StateDead {
+			return
+		}
+		m = &member{Member: u}
+		n.members[u.Name] = m
+		n.enqueue(u)
+		notify(n.cfg.OnJoin, u.Name)
+		if u.State == StateSuspect {
+			n.suspect(m)
+		}
+		return
+	}
+	switch u.State {
+	case StateAlive:
+		if u.Incarnation <= m.Incarnation {
+			return
+		}
+	case StateSuspect:
+		if m.State == StateDead || u.Incarnation < m.Incarnation ||
+			u.Incarnation == m.Incarnation && m.State != StateAlive {
+			return
+		}
+	case StateDead:
+		if m.State == StateDead || u.Incarnation < m.Incarnation {
+			return
+		}
+	}
+	was := m.State
+	m.Member = u
+	n.enqueue(u)
+	if m.suspicion != nil && u.State != StateSuspect {
+		m.suspicion.Stop()
+		m.suspicion = nil
+	}
+	switch {
+	case was == StateDead && u.State != StateDead:
+		notify(n.cfg.OnJoin, u.Name)
+	case was != StateDead && u.State == StateDead:
+		m.died = time.Now()
+		notify(n.cfg.OnLeave, u.Name)
+	}
+	if u.State == StateSuspect {
+		n.suspect(m)
+	}
+}
+
+func notify(fn func(string), name string) {
+	if fn != nil {
+		fn(name)
+	}
+}
+
+// suspect starts the suspicion timer of m, n.mu must be held
+func (n *Node) suspect(m *member) {
+	if m.suspicion != nil {
+		m.suspicion.Stop()
+	}
+	inc := m.Incarnation
+	m.suspicion = time.AfterFunc(n.cfg.SuspicionTimeout, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if m.State == StateSuspect && m.Incarnation == inc {
+			n.merge(Member{Name: m.Name, Addr: m.Addr, State: StateDead, Incarnation: inc})
+		}
+	})
+}
+
+// enqueue queues u for gossip, replacing a pending update of the same
+// member, n.mu must be held
+func (n *Node) enqueue(u Member) {
+	transmits := retransmitFactor * bits.Len(uint(len(n.members)+1))
+	for _, b := range n.queue {
+		if b.m.Name == u.Name {
+			b.m, b.transmits = u, transmits
+			return
+		}
+	}
+	n.queue = append(n.queue, &broadcast{m: u, transmits: transmits})
+}
+
+// send piggybacks pending updates on msg and sends it to addr
+func (n *Node) send(addr string, msg message) {
+	n.mu.Lock()
+	for i := 0; i < len(n.queue) && len(msg.Updates) < maxPiggyback; {
+		b := n.queue[i]
+		msg.Updates = append(msg.Updates, b.m)
+		if b.transmits--; b.transmits <= 0 {
+			n.queue = append(n.queue[:i], n.queue[i+1:]...)
+			continue
+		}
+		i++
+	}
+	n.mu.Unlock()
+	n.sendRaw(addr, msg)
+}
+
+// dropPacket, when set, tells whether a packet from one advertised
+// address to another is dropped. Tests set it to partition nodes.
+var dropPacket func(from, to string) bool
+
+// sendRaw sends msg to addr as it is
+func (n *Node) sendRaw(addr string, msg message) {
+	if dropPacket != nil && dropPacket(n.addr, addr) {
+		return
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("[gossip] encode:", err)
+		return
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Println("[gossip] resolve:", err)
+		return
+	}
+	if _, err := n.conn.WriteToUDP(b, raddr); err != nil {
+		select {
+		case <-n.done:
+		default:
+			log.Println("[gossip] write:", err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package gossip
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// events records the OnJoin and OnLeave calls of a node
+type events struct {
+	mu    sync.Mutex
+	alive map[string]bool
+}
+
+func (e *events) join(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.alive[name] = true
+}
+
+func (e *events) leave(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.alive, name)
+}
+
+func (e *events) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.alive)
+}
+
+// cluster starts n nodes on loopback, each joining through the first
+func cluster(t *testing.T, n int) ([]*Node, []*events) {
+	var nodes []*Node
+	var evs []*events
+	var seeds []string
+	for i := 0; i < n; i++ {
+		ev := &events{alive: make(map[string]bool)}
+		node, err := Start(Config{
+			Name:             fmt.Sprintf("node%d", i),
+			BindAddr:         "127.0.0.1:0",
+			Seeds:            seeds,
+			ProbeInterval:    20 * time.Millisecond,
+			ProbeTimeout:     8 * time.Millisecond,
+			SuspicionTimeout: 100 * time.Millisecond,
+			PushPullInterval: 100 * time.Millisecond,
+			OnJoin:           ev.join,
+			OnLeave:          ev.leave,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		if i == 0 {
+			seeds = []string{node.Addr()}
+		}
+		nodes = append(nodes, node)
+		evs = append(evs, ev)
+	}
+	return nodes, evs
+}
+
+// eventually fails the test unless cond becomes true within a few seconds
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sees tells if node sees exactly the named members, itself included
+func sees(node *Node, names ...string) bool {
+	members := node.Members()
+	if len(members) != len(names) {
+		return false
+	}
+	for i, m := range members {
+		if m.Name != names[i] || m.State != StateAlive {
+			return false
+		}
+	}
+	return true
+}
+
+// blocked holds the pairs of addresses packets are dropped between
+var blocked = struct {
+	sync.Mutex
+	pairs map[[2]string]bool
+}{pairs: make(map[[2]string]bool)}
+
+func init() {
+	dropPacket = func(from, to string) bool {
+		blocked.Lock()
+		defer blocked.Unlock()
+		return blocked.pairs[[2]string{from, to}]
+	}
+}
+
+// partition drops the packets between the nodes of a and those of b,
+// until it is called again or the test ends
+func partition(t *testing.T, a, b []*Node, drop bool) {
+	blocked.Lock()
+	defer blocked.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			for _, pair := range [][2]string{{x.Addr(), y.Addr()}, {y.Addr(), x.Addr()}} {
+				pair := pair
+				if drop {
+					blocked.pairs[pair] = true
+					t.Cleanup(func() {
+						blocked.Lock()
+						defer blocked.Unlock()
+						delete(blocked.pairs, pair)
+					})
+				} else {
+					delete(blocked.pairs, pair)
+				}
+			}
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	nodes, evs := cluster(t, 5)
+	all := []string{"node0", "node1", "node2", "node3", "node4"}
+	for i, node := range nodes {
+		eventually(t, fmt.Sprintf("node%d does not see every member", i), func() bool {
+			return sees(node, all...)
+		})
+		if evs[i].count() != 4 {
+			t.Fatalf("node%d got %d joins", i, evs[i].count())
+		}
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	nodes, evs := cluster(t, 4)
+	for _, node := range nodes {
+		eventually(t, "cluster did not form", func() bool { return len(node.Members()) == 4 })
+	}
+	// crash without leaving
+	nodes[3].Close()
+	for i, node := range nodes[:3] {
+		eventually(t, fmt.Sprintf("node%d did not detect the failure", i), func() bool {
+			return sees(node, "node0", "node1", "node2")
+		})
+		if evs[i].count() != 2 {
+			t.Fatalf("node%d did not get OnLeave", i)
+		}
+	}
+}
+
+func TestIndirectProbe(t *testing.T) {
+	nodes, _ := cluster(t, 3)
+	for _, node := range nodes {
+		eventually(t, "cluster did not form", func() bool { return len(node.Members()) == 3 })
+	}
+	// node0 and node1 cannot reach each other, but both reach node2,
+	// through which they keep acking each other's probes
+	partition(t, nodes[:1], nodes[1:2], true)
+	time.Sleep(400 * time.Millisecond)
+	for i, node := range nodes {
+		if !sees(node, "node0", "node1", "node2") {
+			t.Fatalf("node%d sees %v", i, node.Members())
+		}
+		// never suspected, so never had to refute
+		node.mu.Lock()
+		inc := node.incarnation
+		node.mu.Unlock()
+		if inc != 0 {
+			t.Fatalf("node%d was suspected, incarnation %d", i, inc)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	nodes, evs := cluster(t, 4)
+	for _, node := range nodes {
+		eventually(t, "cluster did not form", func() bool { return len(node.Members()) == 4 })
+	}
+	left, right := nodes[:2], nodes[2:]
+	partition(t, left, right, true)
+	for _, node := range left {
+		eventually(t, "left side did not drop the right one", func() bool {
+			return sees(node, "node0", "node1")
+		})
+	}
+	for _, node := range right {
+		eventually(t, "right side did not drop the left one", func() bool {
+			return sees(node, "node2", "node3")
+		})
+	}
+
+	// once healed, push-pull and refutation merge the two sides back
+	partition(t, left, right, false)
+	for i, node := range nodes {
+		eventually(t, fmt.Sprintf("node%d did not rejoin the other side", i), func() bool {
+			return sees(node, "node0", "node1", "node2", "node3")
+		})
+		if evs[i].count() != 3 {
+			t.Fatalf("node%d has %d members alive after healing", i, evs[i].count())
+		}
+	}
+}
+
+func TestLeave(t *testing.T) {
+	nodes, _ := cluster(t, 3)
+	for _, node := range nodes {
+		eventually(t, "cluster did not form", func() bool { return len(node.Members()) == 3 })
+	}
+	nodes[2].Leave()
+	// well before SuspicionTimeout
+	time.Sleep(20 * time.Millisecond)
+	for i, node := range nodes[:2] {
+		if !sees(node, "node0", "node1") {
+			t.Fatalf("node%d still sees %v", i, node.Members())
+		}
+	}
+}
+
+func TestReapDead(t *testing.T) {
+	nodes, _ := cluster(t, 3)
+	for _, node := range nodes {
+		eventually(t, "cluster did not form", func() bool { return len(node.Members()) == 3 })
+	}
+	nodes[2].Close()
+	// dead after SuspicionTimeout, forgotten DeadRetention later
+	for i, node := range nodes[:2] {
+		node := node
+		eventually(t, fmt.Sprintf("node%d did not forget the dead member", i), func() bool {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			_, ok := node.members["node2"]
+			return !ok
+		})
+		if state := node.state(); len(state) != 2 {
+			t.Fatalf("node%d pushes %v", i, state)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ocache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"ocache/consistenthash"
+	pb "ocache/ocachepb"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCPool implements PeerPicker for a pool of gRPC peers, and serves
+// the GroupCache service declared in ocachepb.proto for them.
+type GRPCPool struct {
+	pb.UnimplementedGroupCacheServer
+
+	// this peer's address, e.g. "10.0.0.2:8008"
+	self        string
+	opts        []grpc.DialOption      // used when dialing peers
+	mu          sync.Mutex             // guards peers, grpcGetters and server
+	peers       *consistenthash.Map    // 根据具体的 key 选择节点
+	grpcGetters map[string]*grpcGetter // keyed by e.g. "10.0.0.2:8008"
+	server      *grpc.Server
+}
+
+// NewGRPCPool initializes a gRPC pool of peers. Peers are dialed without
+// transport security unless opts say otherwise.
+func NewGRPCPool(self string, opts ...grpc.DialOption) *GRPCPool {
+	return &GRPCPool{
+		self: self,
+		opts: append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...),
+	}
+}
+
+// Log info with server name
+func (p *GRPCPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+// Serve accepts incoming GroupCache calls on lis until Stop is called.
+func (p *GRPCPool) Serve(lis net.Listener) error {
+	p.mu.Lock()
+	if p.server == nil {
+		p.server = grpc.NewServer()
+		pb.RegisterGroupCacheServer(p.server, p)
+	}
+	server := p.server
+	p.mu.Unlock()
+	return server.Serve(lis)
+}
+
+// Stop stops serving and closes the connections to every peer.
+func (p *GRPCPool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.server != nil {
+		p.server.Stop()
+	}
+	for _, getter := range p.grpcGetters {
+		getter.close()
+	}
+	p.grpcGetters = nil
+	p.peers = nil
+}
+
+// Get implements pb.GroupCacheServer
+func (p *GRPCPool) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	p.Log("Get %s/%s", in.GetGroup(), in.GetKey())
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Error(codes.NotFound, "no such group: "+in.GetGroup())
+	}
+	group.Stats.ServerRequests.Add(1)
+	res, err := serveGet(ctx, group, in.GetKey())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return res, nil
+}
+
+// Remove implements pb.GroupCacheServer
+func (p *GRPCPool) Remove(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	p.Log("Remove %s/%s", in.GetGroup(), in.GetKey())
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Error(codes.NotFound, "no such group: "+in.GetGroup())
+	}
+	group.removeLocally(in.GetKey())
+	return &pb.Response{}, nil
+}
+
+// Set updates the pool's list of peers.
+func (p *GRPCPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers = consistenthash.New(defaultReplicas, nil)
+	p.peers.Add(peers...)
+	getters := make(map[string]*grpcGetter, len(peers))
+	for _, peer := range peers {
+		if getter, ok := p.grpcGetters[peer]; ok {
+			// keep the connection of a peer that is still in the pool
+			getters[peer] = getter
+			delete(p.grpcGetters, peer)
+			continue
+		}
+		getters[peer] = newGRPCGetter(peer, p.opts)
+	}
+	for _, getter := range p.grpcGetters {
+		getter.close()
+	}
+	p.grpcGetters = getters
+}
+
+// PickPeer picks a peer according to key
+func (p *GRPCPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil, false
+	}
+	if peer := p.peers.Get(key); peer != "" && peer != p.self {
+		p.Log("Pick peer %s", peer)
+		return p.grpcGetters[peer], true
+	}
+	return nil, false
+}
+
+var _ PeerPicker = (*GRPCPool)(nil)
+var _ pb.GroupCacheServer = (*GRPCPool)(nil)
+
+type grpcGetter struct {
+	addr   string
+	conn   *grpc.ClientConn
+	client pb.GroupCacheClient
+	err    error // set if dialing failed
+}
+
+// newGRPCGetter dials addr, the connection itself is established lazily
+func newGRPCGetter(addr string, opts []grpc.DialOption) *grpcGetter {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return &grpcGetter{addr: addr, err: err}
+	}
+	return &grpcGetter{addr: addr, conn: conn, client: pb.NewGroupCacheClient(conn)}
+}
+
+// grpcGetter实现PeerGetter接口
+func (g *grpcGetter) Get(in *pb.Request, out *pb.Response) error {
+	return g.GetContext(context.Background(), in, out)
+}
+
+// GetContext implements ContextPeerGetter, gRPC carries the deadline of ctx to the peer
+func (g *grpcGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	if g.err != nil {
+		return g.err
+	}
+	res, err := g.client.Get(ctx, in)
+	if err != nil {
+		return err
+	}
+	proto.Merge(out, res)
+	return nil
+}
+
+// Remove asks the peer to drop a key
+func (g *grpcGetter) Remove(in *pb.Request) error {
+	return g.RemoveContext(context.Background(), in)
+}
+
+// RemoveContext implements ContextPeerRemover
+func (g *grpcGetter) RemoveContext(ctx context.Context, in *pb.Request) error {
+	if g.err != nil {
+		return g.err
+	}
+	_, err := g.client.Remove(ctx, in)
+	return err
+}
+
+func (g *grpcGetter) close() {
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+var _ PeerGetter = (*grpcGetter)(nil)
+var _ ContextPeerGetter = (*grpcGetter)(nil)
+var _ PeerRemover = (*grpcGetter)(nil)
+var _ ContextPeerRemover = (*grpcGetter)(nil)
@@ -0,0 +1,87 @@
+package ocache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	pb "ocache/ocachepb"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newBufconnPool serves a GRPCPool on an in-process listener and returns
+// a dial option that connects to it.
+func newBufconnPool(t *testing.T, self string) (*GRPCPool, grpc.DialOption) {
+	lis := bufconn.Listen(1 << 20)
+	pool := NewGRPCPool(self)
+	go pool.Serve(lis)
+	t.Cleanup(pool.Stop)
+	dialer := grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+	return pool, dialer
+}
+
+func TestGRPCPool(t *testing.T) {
+	_, dialer := newBufconnPool(t, "b")
+	pool := NewGRPCPool("a", dialer)
+	pool.Set("b") // every key is owned by b
+	defer pool.Stop()
+
+	client := NewGroup("grpc", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer b", key)
+		}), WithHotCache(0, 0))
+	client.RegisterPeers(pool)
+	// the same name registers the group the server side looks up, as if
+	// it lived on another node
+	server := NewGroup("grpc", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("b:" + key), nil
+		}), WithTTL(time.Hour))
+
+	v, err := client.Get("Tom")
+	if err != nil || v.String() != "b:Tom" {
+		t.Fatalf("failed to get Tom from peer b: %v", err)
+	}
+	if v.Expire().IsZero() {
+		t.Fatalf("expire was not carried over gRPC")
+	}
+	if client.Stats.PeerLoads.Get() != 1 || server.Stats.ServerRequests.Get() != 1 {
+		t.Fatalf("PeerLoads = %d, ServerRequests = %d",
+			client.Stats.PeerLoads.Get(), server.Stats.ServerRequests.Get())
+	}
+
+	if err := client.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.mainCache.get("Tom"); ok {
+		t.Fatalf("Remove was not forwarded over gRPC")
+	}
+
+	peer, ok := pool.PickPeer("Tom")
+	if !ok {
+		t.Fatalf("b should own Tom")
+	}
+	err = peer.Get(&pb.Request{Group: "no-such-group", Key: "Tom"}, &pb.Response{})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("unknown group returned %v", err)
+	}
+}
+
+func TestGRPCPoolPickSelf(t *testing.T) {
+	pool := NewGRPCPool("a")
+	if _, ok := pool.PickPeer("Tom"); ok {
+		t.Fatalf("a pool without peers should not pick any")
+	}
+	pool.Set("a")
+	defer pool.Stop()
+	if _, ok := pool.PickPeer("Tom"); ok {
+		t.Fatalf("a pool should not pick itself")
+	}
+}
@@ -1,39 +1,82 @@
 package ocache
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"ocache/breaker"
 	"ocache/consistenthash"
 	pb "ocache/ocachepb"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	defaultBasePath = "/_ocache/"
 	defaultReplicas = 50
+	// statsPath is served under basePath, e.g. "/_ocache/_stats"
+	statsPath = "_stats"
+	// healthPath answers 200 OK while the node serves, for health probes
+	healthPath = "_health"
+	// a peer is skipped after breakerThreshold failed requests or health
+	// probes in a row, and tried again breakerCooldown later
+	breakerThreshold = 3
+	breakerCooldown  = 5 * time.Second
+	// timeoutHeader carries the time left before the caller's deadline,
+	// so the owning peer gives up when the caller does
+	timeoutHeader = "X-Ocache-Timeout"
+	// peerTimeout bounds every request to a peer, so one that hangs
+	// counts against its breaker even when the caller set no deadline
+	peerTimeout = 10 * time.Second
 )
 
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
+//
+// The peer set is copy-on-write: Set, AddPeers and RemovePeers build a new
+// httpPeers and publish it atomically, so PickPeer never takes a lock.
+//
+// Each peer has a circuit breaker fed by the requests made to it and by
+// the health probes started with StartHealthChecks. PickPeer skips the
+// peers whose breaker is open for the next owner on the ring.
 type HTTPPool struct {
 	// this peer's base URL, e.g. "https://example.net:8000"
-	self        string                 // 记录自己的地址，包括主机名/IP 和端口
-	basePath    string                 // 节点间通讯地址的前缀
-	mu          sync.Mutex             // guards peers and httpGetters
-	peers       *consistenthash.Map    //根据具体的 key 选择节点
+	self     string       // 记录自己的地址，包括主机名/IP 和端口
+	basePath string       // 节点间通讯地址的前缀
+	client   *http.Client // shared by the httpGetters, with peerTimeout
+	mu       sync.Mutex   // serializes writers of peers
+	peers    atomic.Value // *httpPeers
+}
+
+// httpPeers is a peer set of an HTTPPool, never modified once published
+type httpPeers struct {
+	ring        *consistenthash.Map    //根据具体的 key 选择节点
 	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
 }
 
 // NewHTTPPool initializes an HTTP pool of peers.
 func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
+	p := &HTTPPool{
 		self:     self,
 		basePath: defaultBasePath,
+		client:   &http.Client{Timeout: peerTimeout},
 	}
+	p.peers.Store(&httpPeers{
+		ring:        consistenthash.New(defaultReplicas, nil),
+		httpGetters: make(map[string]*httpGetter),
+	})
+	return p
+}
+
+func (p *HTTPPool) load() *httpPeers {
+	return p.peers.Load().(*httpPeers)
 }
 
 // Log info with server name
@@ -48,7 +91,15 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !strings.HasPrefix(r.URL.Path, p.basePath) {
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
+	if r.URL.Path == p.basePath+healthPath {
+		w.Write([]byte("ok"))
+		return
+	}
 	p.Log("%s %s", r.Method, r.URL.Path)
+	if r.URL.Path == p.basePath+statsPath {
+		p.serveStats(w, r)
+		return
+	}
 	// /<basepath>/<groupname>/<key> required
 	parts := strings.SplitN(r.URL.Path[len(p.basePath):], "/", 2)
 	if len(parts) != 2 {
@@ -66,8 +117,28 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	view, err := group.Get(key)
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()})
+	// DELETE /<basepath>/<groupname>/<key> 删除本节点上的缓存
+	if r.Method == http.MethodDelete {
+		group.removeLocally(key)
+		return
+	}
+
+	ctx := r.Context()
+	if t := r.Header.Get(timeoutHeader); t != "" {
+		if d, err := time.ParseDuration(t); err == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+	}
+
+	group.Stats.ServerRequests.Add(1)
+	res, err := serveGet(ctx, group, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := proto.Marshal(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -78,44 +149,208 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Set updates the pool's list of peers.
+// groupStats is the JSON form of one group on the stats endpoint
+type groupStats struct {
+	Stats     *Stats      `json:"stats"`
+	MainCache CacheStats  `json:"main_cache"`
+	HotCache  CacheStats  `json:"hot_cache"`
+	Bloom     *BloomStats `json:"bloom,omitempty"`
+}
+
+// serveStats writes the statistics of every group on this node as JSON
+func (p *HTTPPool) serveStats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]groupStats)
+	for name, g := range getGroups() {
+		gs := groupStats{
+			Stats:     &g.Stats,
+			MainCache: g.CacheStats(MainCache),
+			HotCache:  g.CacheStats(HotCache),
+		}
+		if bs, ok := g.BloomStats(); ok {
+			gs.Bloom = &bs
+		}
+		stats[name] = gs
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Set replaces the pool's list of peers. The peers that were already in
+// the pool keep the state of their breaker.
 func (p *HTTPPool) Set(peers ...string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.peers = consistenthash.New(defaultReplicas, nil)
-	p.peers.Add(peers...)
-	p.httpGetters = make(map[string]*httpGetter, len(peers))
+	cur := p.load()
+	next := &httpPeers{
+		ring:        consistenthash.New(defaultReplicas, nil),
+		httpGetters: make(map[string]*httpGetter, len(peers)),
+	}
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.basePath}
+		if _, ok := next.httpGetters[peer]; !ok {
+			next.ring.Add(peer)
+			getter, ok := cur.httpGetters[peer]
+			if !ok {
+				getter = p.newGetter(peer)
+			}
+			next.httpGetters[peer] = getter
+		}
 	}
+	p.peers.Store(next)
 }
 
-// PickPeer picks a peer according to key
-func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+// newGetter returns a getter for peer with a closed breaker
+func (p *HTTPPool) newGetter(peer string) *httpGetter {
+	return &httpGetter{
+		baseURL: peer + p.basePath,
+		client:  p.client,
+		breaker: breaker.New(breakerThreshold, breakerCooldown),
+	}
+}
+
+// AddPeers adds peers to the pool, keeping the others and their place on
+// the ring, so only the keys the new peers take over change owner.
+func (p *HTTPPool) AddPeers(peers ...string) {
+	p.update(peers, func(next *httpPeers, peer string) {
+		if _, ok := next.httpGetters[peer]; !ok {
+			next.ring.Add(peer)
+			next.httpGetters[peer] = p.newGetter(peer)
+		}
+	})
+}
+
+// RemovePeers removes peers from the pool, their keys move to the next
+// peers on the ring.
+func (p *HTTPPool) RemovePeers(peers ...string) {
+	p.update(peers, func(next *httpPeers, peer string) {
+		if _, ok := next.httpGetters[peer]; ok {
+			next.ring.Remove(peer)
+			delete(next.httpGetters, peer)
+		}
+	})
+}
+
+// update applies fn to a copy of the peer set for every peer, then
+// publishes the copy
+func (p *HTTPPool) update(peers []string, fn func(next *httpPeers, peer string)) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if peer := p.peers.Get(key); peer != "" && peer != p.self {
+	cur := p.load()
+	next := &httpPeers{
+		ring:        cur.ring.Clone(),
+		httpGetters: make(map[string]*httpGetter, len(cur.httpGetters)+len(peers)),
+	}
+	for peer, getter := range cur.httpGetters {
+		next.httpGetters[peer] = getter
+	}
+	for _, peer := range peers {
+		fn(next, peer)
+	}
+	p.peers.Store(next)
+}
+
+// Peers returns the peers of the pool, sorted
+func (p *HTTPPool) Peers() []string {
+	cur := p.load()
+	peers := make([]string, 0, len(cur.httpGetters))
+	for peer := range cur.httpGetters {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// PickPeer picks a peer according to key. When the owner's breaker is
+// open the key goes to the next peer on the ring whose breaker lets it
+// through, or to this node if it comes first.
+func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+	cur := p.load()
+	peer := cur.ring.GetFunc(key, func(peer string) bool {
+		return peer == p.self || cur.httpGetters[peer].breaker.Allow()
+	})
+	if peer != "" && peer != p.self {
 		p.Log("Pick peer %s", peer)
-		return p.httpGetters[peer], true
+		return cur.httpGetters[peer], true
 	}
 	return nil, false
 }
 
+// StartHealthChecks probes the health route of every peer each interval,
+// giving each probe that long to answer. Probes that fail count against
+// the peer's breaker like failed requests, one that succeeds closes it.
+// The returned func stops the probes.
+func (p *HTTPPool) StartHealthChecks(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			p.checkHealth(interval)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		wg.Wait()
+	}
+}
+
+// checkHealth probes every peer but this node at once and waits for the
+// answers
+func (p *HTTPPool) checkHealth(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for peer, getter := range p.load().httpGetters {
+		if peer == p.self {
+			continue
+		}
+		wg.Add(1)
+		go func(h *httpGetter) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := h.probe(ctx); err != nil {
+				h.breaker.Failure()
+				return
+			}
+			h.breaker.Success()
+		}(getter)
+	}
+	wg.Wait()
+}
+
 var _ PeerPicker = (*HTTPPool)(nil)
 
 type httpGetter struct {
 	baseURL string
+	client  *http.Client
+	breaker *breaker.Breaker
 }
 
 // httpGetter实现PeerGetter接口
 func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
-	u := fmt.Sprintf(
-		"%v%v/%v",
-		h.baseURL,
-		url.QueryEscape(in.GetGroup()),
-		url.QueryEscape(in.GetKey()),
-	)
-	res, err := http.Get(u)
+	return h.GetContext(context.Background(), in, out)
+}
+
+// GetContext implements ContextPeerGetter, the request is canceled with ctx
+func (h *httpGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	req, err := h.newRequest(ctx, http.MethodGet, in)
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Do(req)
+	h.report(ctx, err)
 	if err != nil {
 		return err
 	}
@@ -132,5 +367,78 @@ func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
 	return nil
 }
 
+// Remove asks the peer to drop a key with a DELETE request
+func (h *httpGetter) Remove(in *pb.Request) error {
+	return h.RemoveContext(context.Background(), in)
+}
+
+// RemoveContext implements ContextPeerRemover
+func (h *httpGetter) RemoveContext(ctx context.Context, in *pb.Request) error {
+	req, err := h.newRequest(ctx, http.MethodDelete, in)
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Do(req)
+	h.report(ctx, err)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// probe asks the peer's health route whether it serves
+func (h *httpGetter) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.baseURL+healthPath, nil)
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// report feeds the outcome of a request to the breaker. Any answer
+// means the peer is up, whatever its status. A request the caller gave
+// up on says nothing about the peer.
+func (h *httpGetter) report(ctx context.Context, err error) {
+	if err == nil {
+		h.breaker.Success()
+	} else if ctx.Err() == nil {
+		h.breaker.Failure()
+	}
+}
+
+// newRequest builds a request to /<basepath>/<groupname>/<key> bound to ctx
+func (h *httpGetter) newRequest(ctx context.Context, method string, in *pb.Request) (*http.Request, error) {
+	u := fmt.Sprintf(
+		"%v%v/%v",
+		h.baseURL,
+		url.QueryEscape(in.GetGroup()),
+		url.QueryEscape(in.GetKey()),
+	)
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(timeoutHeader, time.Until(deadline).String())
+	}
+	return req, nil
+}
+
 // 测试 httpGetter 是否实现了 PeerGetter
 var _ PeerGetter = (*httpGetter)(nil)
+var _ ContextPeerGetter = (*httpGetter)(nil)
+var _ PeerRemover = (*httpGetter)(nil)
+var _ ContextPeerRemover = (*httpGetter)(nil)
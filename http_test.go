@@ -0,0 +1,392 @@
+package ocache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"ocache/breaker"
+	"ocache/gossip"
+	"ocache/lru"
+	pb "ocache/ocachepb"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPRemove(t *testing.T) {
+	g := NewGroup("http-remove", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	g.Get("Tom")
+
+	pool := NewHTTPPool("http://self")
+	srv := httptest.NewServer(pool)
+	defer srv.Close()
+
+	getter := NewHTTPPool("").newGetter(srv.URL)
+	if err := getter.Remove(&pb.Request{Group: "http-remove", Key: "Tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("Tom should be removed by DELETE")
+	}
+
+	err := getter.Remove(&pb.Request{Group: "no-such-group", Key: "Tom"})
+	if err == nil {
+		t.Fatalf("removing from an unknown group should fail")
+	}
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, defaultBasePath+"http-remove/Sam", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE returned %d", w.Code)
+	}
+}
+
+func TestHTTPStats(t *testing.T) {
+	g := NewGroup("http-stats", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	pool := NewHTTPPool("http://self")
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+"http-stats/Tom", nil))
+	}
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+statsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("stats returned %d", w.Code)
+	}
+	var stats map[string]struct {
+		Stats     map[string]int64 `json:"stats"`
+		MainCache CacheStats       `json:"main_cache"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := stats["http-stats"]
+	if !ok {
+		t.Fatalf("group http-stats missing in %s", w.Body.String())
+	}
+	if s.Stats["gets"] != 2 || s.Stats["cache_hits"] != 1 || s.Stats["local_loads"] != 1 || s.Stats["server_requests"] != 2 {
+		t.Fatalf("unexpected group stats %v", s.Stats)
+	}
+	if s.MainCache.Items != 1 || s.MainCache.Bytes != int64(len("TomTom"))+lru.EntryOverhead || s.MainCache.Hits != 1 {
+		t.Fatalf("unexpected main cache stats %+v", s.MainCache)
+	}
+	if g.Stats.Gets.Get() != 2 {
+		t.Fatalf("Stats.Gets = %d", g.Stats.Gets.Get())
+	}
+}
+
+func TestHTTPGetContext(t *testing.T) {
+	NewGroup("http-context", 2<<10, 1, 30, ContextGetterFunc(
+		func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return nil, 0, fmt.Errorf("deadline of the caller was not propagated")
+			}
+			return []byte(key), 0, nil
+		}))
+	srv := httptest.NewServer(NewHTTPPool("http://self"))
+	defer srv.Close()
+
+	getter := NewHTTPPool("").newGetter(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	out := &pb.Response{}
+	if err := getter.GetContext(ctx, &pb.Request{Group: "http-context", Key: "Tom"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Value) != "Tom" {
+		t.Fatalf("got %q, expect Tom", out.Value)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := getter.GetContext(canceled, &pb.Request{Group: "http-context", Key: "Sam"}, out); err == nil {
+		t.Fatalf("a canceled context should fail the request")
+	}
+	// without a deadline the server side load fails, and so does the peer call
+	if err := getter.Get(&pb.Request{Group: "http-context", Key: "Jack"}, out); err == nil {
+		t.Fatalf("load errors on the peer should be returned")
+	}
+}
+
+func TestHTTPNotFound(t *testing.T) {
+	NewGroup("http-not-found", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, ErrNotFound
+		}))
+	srv := httptest.NewServer(NewHTTPPool("http://self"))
+	defer srv.Close()
+
+	getter := NewHTTPPool("").newGetter(srv.URL)
+	out := &pb.Response{}
+	if err := getter.Get(&pb.Request{Group: "http-not-found", Key: "Tom"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.NotFound {
+		t.Fatalf("ErrNotFound should be carried in the response")
+	}
+}
+
+// owner returns the peer PickPeer chose for key, "" for self
+func owner(p *HTTPPool, key string) string {
+	if peer, ok := p.PickPeer(key); ok {
+		return peer.(*httpGetter).baseURL
+	}
+	return ""
+}
+
+func TestHTTPPoolPeers(t *testing.T) {
+	pool := NewHTTPPool("http://a")
+	if _, ok := pool.PickPeer("key"); ok {
+		t.Fatalf("a pool without peers should not pick any")
+	}
+	pool.Set("http://a", "http://b", "http://c")
+
+	keys := make([]string, 1000)
+	before := make(map[string]string)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		before[keys[i]] = owner(pool, keys[i])
+	}
+
+	pool.AddPeers("http://d", "http://b")
+	if peers := pool.Peers(); !reflect.DeepEqual(peers, []string{"http://a", "http://b", "http://c", "http://d"}) {
+		t.Fatalf("peers %v", peers)
+	}
+	moved := 0
+	for _, key := range keys {
+		if o := owner(pool, key); o != before[key] {
+			if o != "http://d"+defaultBasePath {
+				t.Fatalf("%s moved from %s to %s, not to the new peer", key, before[key], o)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(keys)/2 {
+		t.Fatalf("%d keys moved to the new peer", moved)
+	}
+
+	pool.RemovePeers("http://d", "http://e")
+	for _, key := range keys {
+		if o := owner(pool, key); o != before[key] {
+			t.Fatalf("%s owned by %s after removing d, want %s", key, o, before[key])
+		}
+	}
+	pool.RemovePeers("http://c")
+	for _, key := range keys {
+		if o := owner(pool, key); before[key] != "http://c"+defaultBasePath && o != before[key] {
+			t.Fatalf("%s moved from %s although c did not own it", key, before[key])
+		}
+	}
+}
+
+func TestHTTPPoolConcurrent(t *testing.T) {
+	pool := NewHTTPPool("http://self")
+	pool.Set("http://a", "http://b")
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if peer, ok := pool.PickPeer(fmt.Sprintf("key%d", j)); ok && peer == nil {
+					t.Errorf("picked a peer without a getter")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		peer := fmt.Sprintf("http://%d", i%10)
+		pool.AddPeers(peer)
+		pool.RemovePeers(peer)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestHTTPPoolGossip(t *testing.T) {
+	cfg := gossip.Config{
+		BindAddr:         "127.0.0.1:0",
+		ProbeInterval:    20 * time.Millisecond,
+		SuspicionTimeout: 100 * time.Millisecond,
+	}
+	var pools []*HTTPPool
+	var nodes []*gossip.Node
+	for _, self := range []string{"http://a", "http://b", "http://c"} {
+		pool := NewHTTPPool(self)
+		node, err := pool.StartGossip(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		if len(nodes) == 0 {
+			cfg.Seeds = []string{node.Addr()}
+		}
+		pools = append(pools, pool)
+		nodes = append(nodes, node)
+	}
+	want := []string{"http://a", "http://b", "http://c"}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, pool := range pools {
+		for !reflect.DeepEqual(pool.Peers(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("pool of %s has peers %v", pool.self, pool.Peers())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	nodes[2].Leave()
+	for _, pool := range pools[:2] {
+		for !reflect.DeepEqual(pool.Peers(), want[:2]) {
+			if time.Now().After(deadline) {
+				t.Fatalf("pool of %s has peers %v", pool.self, pool.Peers())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// staticDiscovery hands its update func to the test
+type staticDiscovery struct {
+	peers  []string
+	update func(peers []string)
+}
+
+func (d *staticDiscovery) Watch(update func(peers []string)) error {
+	d.update = update
+	update(d.peers)
+	return nil
+}
+
+func (d *staticDiscovery) Stop() {}
+
+func TestHTTPPoolDiscover(t *testing.T) {
+	pool := NewHTTPPool("http://a")
+	d := &staticDiscovery{peers: []string{"http://a", "http://b"}}
+	if err := pool.Discover(d); err != nil {
+		t.Fatal(err)
+	}
+	if peers := pool.Peers(); !reflect.DeepEqual(peers, []string{"http://a", "http://b"}) {
+		t.Fatalf("got peers %v", peers)
+	}
+	d.update([]string{"http://a", "http://c"})
+	if peers := pool.Peers(); !reflect.DeepEqual(peers, []string{"http://a", "http://c"}) {
+		t.Fatalf("got peers %v after a change", peers)
+	}
+	for i := 0; i < 100; i++ {
+		if peer := owner(pool, fmt.Sprint(i)); peer != "" && peer != "http://c"+defaultBasePath {
+			t.Fatalf("key %d is owned by %s", i, peer)
+		}
+	}
+
+	// a list without this node is ignored
+	d.update([]string{"http://b", "http://c"})
+	if peers := pool.Peers(); !reflect.DeepEqual(peers, []string{"http://a", "http://c"}) {
+		t.Fatalf("got peers %v after a list without self", peers)
+	}
+	other := NewHTTPPool("http://node1.example.com:8001")
+	if err := other.Discover(&staticDiscovery{peers: []string{"http://a", "http://b"}}); err == nil {
+		t.Fatal("a first list without self is accepted")
+	}
+	if peers := other.Peers(); len(peers) != 0 {
+		t.Fatalf("got peers %v from a list without self", peers)
+	}
+}
+
+func TestHTTPPoolBreaker(t *testing.T) {
+	live := httptest.NewServer(NewHTTPPool("live"))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	pool := NewHTTPPool("http://self")
+	pool.Set("http://self", live.URL, dead.URL)
+	getters := pool.load().httpGetters
+	var key string
+	for i := 0; key == ""; i++ {
+		if owner(pool, fmt.Sprint(i)) == dead.URL+defaultBasePath {
+			key = fmt.Sprint(i)
+		}
+	}
+
+	// failed requests open the dead peer's breaker, its keys then go to
+	// the next owner on the ring
+	peer, _ := pool.PickPeer(key)
+	for i := 0; i < breakerThreshold; i++ {
+		if err := peer.Get(&pb.Request{Group: "g", Key: key}, &pb.Response{}); err == nil {
+			t.Fatal("got a value from a dead peer")
+		}
+	}
+	if getters[dead.URL].breaker.State() != breaker.Open {
+		t.Fatalf("breaker of the dead peer is %v", getters[dead.URL].breaker.State())
+	}
+	if got := owner(pool, key); got == dead.URL+defaultBasePath {
+		t.Fatal("picked a peer whose breaker is open")
+	}
+
+	// the health route answers without a group
+	res, err := http.Get(live.URL + defaultBasePath + healthPath)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("health route got %v %v", res, err)
+	}
+	res.Body.Close()
+
+	// probes close the breaker of a peer that serves again, and keep the
+	// dead one open
+	for i := 0; i < breakerThreshold; i++ {
+		getters[live.URL].breaker.Failure()
+	}
+	stop := pool.StartHealthChecks(10 * time.Millisecond)
+	defer stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for getters[live.URL].breaker.State() != breaker.Closed {
+		if time.Now().After(deadline) {
+			t.Fatal("health checks did not close the breaker of the live peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if getters[dead.URL].breaker.State() != breaker.Open {
+		t.Fatalf("breaker of the dead peer is %v after health checks", getters[dead.URL].breaker.State())
+	}
+}
+
+func TestHTTPPoolTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	// requests without a deadline give up after the pool's timeout and
+	// count against the peer's breaker
+	pool := NewHTTPPool("http://self")
+	pool.client.Timeout = 20 * time.Millisecond
+	pool.Set(hung.URL)
+	getter := pool.load().httpGetters[hung.URL]
+	for i := 0; i < breakerThreshold; i++ {
+		if err := getter.Get(&pb.Request{Group: "g", Key: "k"}, &pb.Response{}); err == nil {
+			t.Fatal("got a value from a hung peer")
+		}
+	}
+	if getter.breaker.State() != breaker.Open {
+		t.Fatalf("breaker of the hung peer is %v", getter.breaker.State())
+	}
+}
@@ -0,0 +1,96 @@
+package lru
+
+// ARC is the Adaptive Replacement Cache policy (Megiddo and Modha). It
+// splits cached keys into t1, seen once recently, and t2, seen at least
+// twice, and remembers recently evicted keys of each in the ghost lists
+// b1 and b2. A ghost hit moves the target size p of t1 towards the list
+// that would have kept the key.
+//
+// The cache is bounded by bytes, not by count, so the capacity c of the
+// paper is taken as the number of keys currently cached.
+type ARC struct {
+	p        int // target size of t1
+	t1, t2   *lruList
+	b1, b2   *lruList
+	lastInB2 bool // the last added key was a ghost hit in b2
+}
+
+// NewARC creates an ARC policy
+func NewARC() *ARC {
+	return &ARC{
+		t1: newLRUList(),
+		t2: newLRUList(),
+		b1: newLRUList(),
+		b2: newLRUList(),
+	}
+}
+
+func (p *ARC) capacity() int {
+	return p.t1.len() + p.t2.len()
+}
+
+func (p *ARC) Admit(key string) bool { return true }
+
+func (p *ARC) Add(key string) {
+	p.lastInB2 = false
+	c := p.capacity()
+	switch {
+	case p.b1.contains(key):
+		// recency would have kept it, grow t1
+		p.p = minInt(p.p+maxInt(p.b2.len()/p.b1.len(), 1), c)
+		p.b1.remove(key)
+		p.t2.pushFront(key)
+	case p.b2.contains(key):
+		// frequency would have kept it, shrink t1
+		p.p = maxInt(p.p-maxInt(p.b1.len()/p.b2.len(), 1), 0)
+		p.b2.remove(key)
+		p.t2.pushFront(key)
+		p.lastInB2 = true
+	default:
+		p.t1.pushFront(key)
+	}
+}
+
+func (p *ARC) Hit(key string) {
+	if p.t1.remove(key) {
+		p.t2.pushFront(key)
+		return
+	}
+	p.t2.moveToFront(key)
+}
+
+func (p *ARC) Miss(key string) {}
+
+// Victim implements REPLACE of the paper
+func (p *ARC) Victim() (string, bool) {
+	if t1 := p.t1.len(); t1 > 0 && (t1 > p.p || (p.lastInB2 && t1 == p.p) || p.t2.len() == 0) {
+		return p.t1.back()
+	}
+	return p.t2.back()
+}
+
+func (p *ARC) Remove(key string, reason EvictReason) {
+	if reason != EvictCapacity {
+		// the key is gone for good, don't let a ghost of it adapt p
+		p.t1.remove(key)
+		p.t2.remove(key)
+		p.b1.remove(key)
+		p.b2.remove(key)
+		return
+	}
+	if p.t1.remove(key) {
+		p.b1.pushFront(key)
+	} else if p.t2.remove(key) {
+		p.b2.pushFront(key)
+	}
+	// |t1|+|b1| <= c and |t1|+|t2|+|b1|+|b2| <= 2c
+	c := maxInt(p.capacity(), 1)
+	for p.t1.len()+p.b1.len() > c && p.b1.len() > 0 {
+		p.b1.popBack()
+	}
+	for p.capacity()+p.b1.len()+p.b2.len() > 2*c && p.b2.len() > 0 {
+		p.b2.popBack()
+	}
+}
+
+var _ EvictionPolicy = (*ARC)(nil)
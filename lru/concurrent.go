@@ -0,0 +1,307 @@
+package lru
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrentCache is a Cache that is safe for concurrent use and whose
+// Get takes no lock. Entries live in a sync.Map and are never modified
+// in place. A Get only records the access in a ring buffer taken from a
+// sync.Pool, so roughly one per P, and full rings are handed to the
+// EvictionPolicy in batches by a drain goroutine under the write lock.
+//
+// Like Ristretto, rings are dropped when the drain falls behind, so the
+// policy sees a sampled, approximate access history in exchange for
+// reads that never wait on writers.
+type ConcurrentCache struct {
+	maxBytes  int64
+	onEvicted func(key string, value Value, reason EvictReason)
+
+	items    sync.Map // key -> *entry
+	rings    sync.Pool
+	pending  chan []access // full rings waiting to be drained
+	free     chan []access // drained rings to reuse
+	draining int32         // 1 while a drain goroutine is scheduled
+
+	mu     sync.Mutex // guards policy and serializes writers
+	policy EvictionPolicy
+	nbytes int64 // read atomically, written under mu
+	nitems int64
+	nevict int64
+	cost   CostFunc // what an entry is charged, KeyValueCost by default
+	clock  uint64   // ticks on every drained hit and Add, orders Items
+}
+
+// access is one Get recorded in a ring
+type access struct {
+	key string
+	hit bool
+}
+
+const (
+	ringSize     = 64 // accesses buffered before a ring is handed over
+	pendingRings = 16 // full rings that may wait for the drain
+)
+
+// NewConcurrent creates a ConcurrentCache whose admission and eviction are decided by policy
+func NewConcurrent(maxBytes int64, policy EvictionPolicy, onEvicted func(string, Value, EvictReason)) *ConcurrentCache {
+	c := &ConcurrentCache{
+		maxBytes:  maxBytes,
+		onEvicted: onEvicted,
+		pending:   make(chan []access, pendingRings),
+		free:      make(chan []access, pendingRings),
+		policy:    policy,
+		cost:      KeyValueCost,
+	}
+	c.rings.New = func() interface{} {
+		buf := make([]access, 0, ringSize)
+		return &buf
+	}
+	return c
+}
+
+// SetCost replaces what entries are charged against maxBytes, e.g. with
+// EstimatedCost. It must be called before the first Add.
+func (c *ConcurrentCache) SetCost(cost CostFunc) {
+	c.cost = cost
+}
+
+// Get looks up key without locking, dropping the entry if it has expired
+func (c *ConcurrentCache) Get(key string) (Value, bool) {
+	v, ok := c.items.Load(key)
+	if !ok {
+		c.record(key, false)
+		return nil, false
+	}
+	kv := v.(*entry)
+	if kv.expired(time.Now()) {
+		c.mu.Lock()
+		// another writer may have replaced or dropped it meanwhile
+		if v, ok := c.items.Load(key); ok && v.(*entry) == kv {
+			c.removeEntry(kv, EvictExpired)
+		}
+		c.mu.Unlock()
+		c.record(key, false)
+		return nil, false
+	}
+	c.record(key, true)
+	return kv.value, true
+}
+
+// record buffers an access, handing the ring over once it is full
+func (c *ConcurrentCache) record(key string, hit bool) {
+	ring := c.rings.Get().(*[]access)
+	*ring = append(*ring, access{key: key, hit: hit})
+	if len(*ring) >= ringSize {
+		select {
+		case c.pending <- *ring:
+		default: // the drain is behind, lose these accesses
+		}
+		select {
+		case *ring = <-c.free:
+		default:
+			*ring = make([]access, 0, ringSize)
+		}
+		c.scheduleDrain()
+	}
+	c.rings.Put(ring)
+}
+
+// scheduleDrain starts a drain goroutine unless one is already scheduled
+func (c *ConcurrentCache) scheduleDrain() {
+	if !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		return
+	}
+	go func() {
+		c.mu.Lock()
+		c.drain()
+		c.mu.Unlock()
+		atomic.StoreInt32(&c.draining, 0)
+	}()
+}
+
+// drain replays the pending accesses to the policy, c.mu must be held
+func (c *ConcurrentCache) drain() {
+	for {
+		select {
+		case ring := <-c.pending:
+			for _, a := range ring {
+				if v, ok := c.items.Load(a.key); ok && a.hit {
+					c.policy.Hit(a.key)
+					c.clock++
+					v.(*entry).access = c.clock
+				} else if !a.hit {
+					c.policy.Miss(a.key)
+				}
+			}
+			select {
+			case c.free <- ring[:0]:
+			default:
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Add adds a value that never expires.
+func (c *ConcurrentCache) Add(key string, value Value) {
+	c.AddWithExpire(key, value, time.Time{})
+}
+
+// AddWithExpire adds a value that is dropped once expire has passed.
+// A zero expire means the entry never expires.
+func (c *ConcurrentCache) AddWithExpire(key string, value Value, expire time.Time) {
+	c.AddWithCost(key, value, expire, 0)
+}
+
+// AddWithCost adds a value charged cost against maxBytes instead of what
+// the CostFunc says, unless cost is 0.
+func (c *ConcurrentCache) AddWithCost(key string, value Value, expire time.Time, cost int64) {
+	if cost == 0 {
+		cost = c.cost(key, value)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain()
+	c.clock++
+	kv := &entry{key: key, value: value, expire: expire, cost: cost, access: c.clock}
+	if v, ok := c.items.Load(key); ok {
+		// readers may hold the old entry, so store a new one instead of updating it
+		c.items.Store(key, kv)
+		atomic.AddInt64(&c.nbytes, cost-v.(*entry).cost)
+		c.policy.Hit(key)
+	} else {
+		if !c.policy.Admit(key) {
+			c.shrink()
+			return
+		}
+		c.items.Store(key, kv)
+		atomic.AddInt64(&c.nitems, 1)
+		atomic.AddInt64(&c.nbytes, cost)
+		c.policy.Add(key)
+	}
+	c.shrink()
+}
+
+// shrink removes the entries chosen by the policy while the cache is over
+// maxBytes, like Cache.shrink, c.mu must be held
+func (c *ConcurrentCache) shrink() {
+	if c.maxBytes == 0 {
+		return
+	}
+	h, shared := c.policy.(historyPolicy)
+	shared = shared && h.SharedHistory()
+	for {
+		var history int64
+		if shared {
+			history = h.HistoryBytes()
+		}
+		if c.nbytes+history <= c.maxBytes {
+			return
+		}
+		if history > c.maxBytes/2 && h.DropHistory() {
+			continue
+		}
+		if victim, ok := c.policy.Victim(); ok {
+			v, _ := c.items.Load(victim)
+			c.removeEntry(v.(*entry), EvictCapacity)
+			continue
+		}
+		if !(shared && h.DropHistory()) {
+			return
+		}
+	}
+}
+
+// removeEntry drops kv from the map and the policy, c.mu must be held
+func (c *ConcurrentCache) removeEntry(kv *entry, reason EvictReason) {
+	c.items.Delete(kv.key)
+	c.policy.Remove(kv.key, reason)
+	atomic.AddInt64(&c.nitems, -1)
+	atomic.AddInt64(&c.nbytes, -kv.cost)
+	if reason != EvictRemoved {
+		atomic.AddInt64(&c.nevict, 1)
+	}
+	if c.onEvicted != nil {
+		c.onEvicted(kv.key, kv.value, reason)
+	}
+}
+
+// Remove deletes key from the cache and makes the policy forget it
+func (c *ConcurrentCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.items.Load(key); ok {
+		c.removeEntry(v.(*entry), EvictRemoved)
+		return
+	}
+	c.policy.Remove(key, EvictRemoved)
+}
+
+// RemoveExpired drops every cached entry whose deadline is before now
+// and returns how many were removed.
+func (c *ConcurrentCache) RemoveExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	c.items.Range(func(_, v interface{}) bool {
+		if kv := v.(*entry); kv.expired(now) {
+			c.removeEntry(kv, EvictExpired)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// GetNBytes returns the bytes taken by keys and values, plus the history
+// of the policy, whether or not it counts toward maxBytes
+func (c *ConcurrentCache) GetNBytes() int64 {
+	return atomic.LoadInt64(&c.nbytes) + c.HistoryBytes()
+}
+
+func (c *ConcurrentCache) GetMaxBytes() int64 {
+	return c.maxBytes
+}
+
+func (c *ConcurrentCache) Len() int {
+	return int(atomic.LoadInt64(&c.nitems))
+}
+
+// HistoryLen returns the number of keys the policy tracks outside the cache
+func (c *ConcurrentCache) HistoryLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.policy.(historyPolicy); ok {
+		return h.HistoryLen()
+	}
+	return 0
+}
+
+// HistoryBytes returns the estimated memory taken by the policy's history
+func (c *ConcurrentCache) HistoryBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.policy.(historyPolicy); ok {
+		return h.HistoryBytes()
+	}
+	return 0
+}
+
+// Evictions returns how many entries were dropped for capacity or expiry
+func (c *ConcurrentCache) Evictions() int64 {
+	return atomic.LoadInt64(&c.nevict)
+}
+
+// Promotions returns how many keys moved from the history into the cache
+func (c *ConcurrentCache) Promotions() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.policy.(historyPolicy); ok {
+		return h.Promotions()
+	}
+	return 0
+}
@@ -0,0 +1,23 @@
+package lru
+
+// CostFunc returns what an entry is charged against maxBytes
+type CostFunc func(key string, value Value) int64
+
+// EntryOverhead estimates the heap taken by one entry besides the bytes
+// of its key and value: the map slots of the cache and of the policy,
+// the entry itself, the policy's list or heap element and the Value boxed
+// in an interface. Measured with runtime.MemStats, the policies of this
+// package take between about 190 and 260 bytes.
+const EntryOverhead = 240
+
+// KeyValueCost charges the bytes of the key and of the value, it is the
+// default of Cache and ConcurrentCache
+func KeyValueCost(key string, value Value) int64 {
+	return int64(len(key)) + int64(value.Len())
+}
+
+// EstimatedCost charges the key and value bytes plus EntryOverhead, so
+// that maxBytes approximately bounds the heap the cache takes
+func EstimatedCost(key string, value Value) int64 {
+	return KeyValueCost(key, value) + EntryOverhead
+}
@@ -0,0 +1,88 @@
+package lru
+
+import "container/heap"
+
+// LFU evicts the least frequently used key, ties go to the least
+// recently used one.
+type LFU struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	tick  uint64 // logical clock for recency
+}
+
+type lfuItem struct {
+	key   string
+	freq  uint64
+	tick  uint64
+	index int // position in the heap
+}
+
+// lfuHeap is a min-heap ordered by (freq, tick)
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// NewLFU creates an LFU policy
+func NewLFU() *LFU {
+	return &LFU{items: make(map[string]*lfuItem)}
+}
+
+func (p *LFU) Admit(key string) bool { return true }
+
+func (p *LFU) Add(key string) {
+	p.tick++
+	item := &lfuItem{key: key, freq: 1, tick: p.tick}
+	p.items[key] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *LFU) Hit(key string) {
+	if item, ok := p.items[key]; ok {
+		p.tick++
+		item.freq++
+		item.tick = p.tick
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *LFU) Miss(key string) {}
+
+func (p *LFU) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].key, true
+}
+
+func (p *LFU) Remove(key string, reason EvictReason) {
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, key)
+	}
+}
+
+var _ EvictionPolicy = (*LFU)(nil)
@@ -1,27 +1,58 @@
 package lru
 
 import (
-	"container/list"
+	"time"
 )
 
 // Cache 缓存对象，定义了缓存的基本结构
+// Cache keeps the values and their size accounting, while an
+// EvictionPolicy decides which keys get in and which one leaves first.
 type Cache struct {
-	maxBytes    int64                         // max memory size that can be taken
-	nbytes      int64                         // amount of memory have been taken
-	cacheLL     *list.List                    // 管理元素顺序(实现LRU)
-	cache       map[string]*list.Element      // store the relationship between key and value
-	onEvicted   func(key string, value Value) // optional and executed when an entry is purged.
-	K           int                           // LRU-K
-	historyLL   *list.List                    // 管理历史记录
-	history     map[string]*list.Element      // 存放历史记录键值对
-	historyRest int
-}
-
-// entry cache linked list存储的结构体
-// advantage to store key value in linked list: when merge element, use key to delete relationship from dict
+	maxBytes  int64                                             // max memory size that can be taken
+	nbytes    int64                                             // amount of memory have been taken
+	cache     map[string]*entry                                 // store the relationship between key and value
+	onEvicted func(key string, value Value, reason EvictReason) // optional and executed when an entry is purged.
+	policy    EvictionPolicy                                    // 淘汰策略，默认 LRU-K
+	nevict    int64                                             // entries dropped for capacity or expiry
+	cost      CostFunc                                          // what an entry is charged, KeyValueCost by default
+	clock     uint64                                            // ticks on every Get hit and Add, orders Items
+}
+
+// entry cache dict存储的结构体
 type entry struct {
-	key   string
-	value Value
+	key    string
+	value  Value
+	expire time.Time // zero means the entry never expires
+	cost   int64     // charged against maxBytes
+	access uint64    // clock of the latest Get hit or Add
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && now.After(e.expire)
+}
+
+// EvictReason tells onEvicted why an entry left the cache.
+type EvictReason int
+
+const (
+	// EvictCapacity means the entry was removed to keep nbytes under maxBytes.
+	EvictCapacity EvictReason = iota
+	// EvictExpired means the entry's deadline had passed.
+	EvictExpired
+	// EvictRemoved means the entry was deleted explicitly by Remove.
+	EvictRemoved
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictRemoved:
+		return "removed"
+	}
+	return "unknown"
 }
 
 // Value use Len() to count how many bytes it takes
@@ -29,133 +60,173 @@ type Value interface {
 	Len() int
 }
 
-// historyCounter history linked list存储的结构体
-type historyCounter struct {
-	key  string
-	time int
+// New is the Constructor of Cache, using the LRU-K policy
+func New(k int, maxBytes int64, historyMax int, onEvicted func(string, Value, EvictReason)) *Cache {
+	return NewWithPolicy(maxBytes, NewLRUK(k, historyMax), onEvicted)
 }
 
-// New is the Constructor of Cache
-func New(k int, maxBytes int64, historyMax int, onEvicted func(string, Value)) *Cache {
+// NewWithPolicy creates a Cache whose admission and eviction are decided by policy
+func NewWithPolicy(maxBytes int64, policy EvictionPolicy, onEvicted func(string, Value, EvictReason)) *Cache {
 	return &Cache{
-		maxBytes:    maxBytes,
-		cacheLL:     list.New(),
-		cache:       make(map[string]*list.Element),
-		onEvicted:   onEvicted,
-		K:           k,
-		historyLL:   list.New(),
-		history:     make(map[string]*list.Element),
-		historyRest: historyMax,
+		maxBytes:  maxBytes,
+		cache:     make(map[string]*entry),
+		onEvicted: onEvicted,
+		policy:    policy,
+		cost:      KeyValueCost,
 	}
 }
 
-// removeOldest remove oldest element from cache
-func (c *Cache) removeOldest() {
-	ele := c.cacheLL.Back()
-	if ele != nil {
-		// remove from cacheLL
-		c.cacheLL.Remove(ele)
-		kv := ele.Value.(*entry)
-		// delete from dict
-		delete(c.cache, kv.key)
-		c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
-		if c.onEvicted != nil {
-			c.onEvicted(kv.key, kv.value)
-		}
-	}
+// SetCost replaces what entries are charged against maxBytes, e.g. with
+// EstimatedCost. It must be called before the first Add.
+func (c *Cache) SetCost(cost CostFunc) {
+	c.cost = cost
 }
 
-// addToCache add key value pair from history to cache
-func (c *Cache) addToCache(key string, value Value) {
-	// if key exist in cache, update the value and move the element to the end of queue.
-	if ele, ok := c.cache[key]; ok {
-		c.cacheLL.MoveToFront(ele)
-		kv := ele.Value.(*entry)
-		c.nbytes += int64(value.Len()) - int64(kv.value.Len())
-		kv.value = value
-	} else {
-		ele := c.cacheLL.PushFront(&entry{
-			key:   key,
-			value: value,
-		})
-		c.cache[key] = ele
-		c.nbytes += int64(len(key)) + int64(value.Len())
-	}
-	// if nBytes is excess maxBytes, remove the oldest element
-	for c.maxBytes != 0 && c.maxBytes < c.nbytes {
-		c.removeOldest()
+// removeOldest remove the entry chosen by the policy from cache
+func (c *Cache) removeOldest() bool {
+	key, ok := c.policy.Victim()
+	if !ok {
+		return false
 	}
+	c.removeEntry(c.cache[key], EvictCapacity)
+	return true
 }
 
-func (c *Cache) historyReplacingCheck() {
-	if c.historyRest == 0 {
-		// true: trigger LRU history
-		tail := c.historyLL.Back()
-		c.historyLL.Remove(tail)
-		delete(c.history, tail.Value.(historyCounter).key)
-		c.historyRest++
+// removeEntry drops kv from the dict and the policy, then notifies onEvicted
+func (c *Cache) removeEntry(kv *entry, reason EvictReason) {
+	delete(c.cache, kv.key)
+	c.policy.Remove(kv.key, reason)
+	c.nbytes -= kv.cost
+	if reason != EvictRemoved {
+		c.nevict++
 	}
-}
-
-func (c *Cache) deleteFromHistory(key string) {
-	if ele, ok := c.history[key]; !ok {
-		return
-	} else {
-		delete(c.history, key)
-		c.historyLL.Remove(ele)
-		c.historyRest++
+	if c.onEvicted != nil {
+		c.onEvicted(kv.key, kv.value, reason)
 	}
 }
 
 // Get has two steps
-// 1.find element from dict
-// 2.move element to the end of queue (we assume Front is the end)
+// 1.find element from dict, dropping it if it has expired
+// 2.tell the policy about the hit or the miss
 func (c *Cache) Get(key string) (Value, bool) {
-	if ele, ok := c.cache[key]; ok {
-		// move ele to the end of queue
-		c.cacheLL.MoveToFront(ele)
-		kv := ele.Value.(*entry) // conversion: interface{} -> entry
+	if kv, ok := c.cache[key]; ok {
+		if kv.expired(time.Now()) {
+			c.removeEntry(kv, EvictExpired)
+			c.policy.Miss(key)
+			c.shrink()
+			return nil, false
+		}
+		c.policy.Hit(key)
+		c.clock++
+		kv.access = c.clock
 		return kv.value, true
 	}
+	// a miss may grow the policy's history
+	c.policy.Miss(key)
+	c.shrink()
 	return nil, false
 }
 
+// Add adds a value that never expires.
 func (c *Cache) Add(key string, value Value) {
-	var (
-		hc historyCounter
-	)
+	c.AddWithExpire(key, value, time.Time{})
+}
 
-	// special case: LRU
-	if c.K == 1 {
-		c.addToCache(key, value)
+// AddWithExpire adds a value that is dropped once expire has passed.
+// A zero expire means the entry never expires.
+func (c *Cache) AddWithExpire(key string, value Value, expire time.Time) {
+	c.AddWithCost(key, value, expire, 0)
+}
+
+// AddWithCost adds a value charged cost against maxBytes instead of what
+// the CostFunc says, unless cost is 0.
+func (c *Cache) AddWithCost(key string, value Value, expire time.Time, cost int64) {
+	if cost == 0 {
+		cost = c.cost(key, value)
+	}
+	// if key exist in cache, update the value and count it as an access.
+	if kv, ok := c.cache[key]; ok {
+		c.nbytes += cost - kv.cost
+		kv.value = value
+		kv.expire = expire
+		kv.cost = cost
+		c.clock++
+		kv.access = c.clock
+		c.policy.Hit(key)
+	} else {
+		// the policy may keep a new key out, e.g. LRU-K until its K-th visit
+		if !c.policy.Admit(key) {
+			c.shrink()
+			return
+		}
+		c.clock++
+		c.cache[key] = &entry{
+			key:    key,
+			value:  value,
+			expire: expire,
+			cost:   cost,
+			access: c.clock,
+		}
+		c.nbytes += cost
+		c.policy.Add(key)
+	}
+	c.shrink()
+}
+
+// shrink removes the entries chosen by the policy while nbytes exceeds
+// maxBytes. A shared history counts toward maxBytes too, it is trimmed
+// first when it takes more than half of maxBytes, and otherwise only
+// once no entries are left.
+func (c *Cache) shrink() {
+	if c.maxBytes == 0 {
+		return
+	}
+	h, shared := c.policy.(historyPolicy)
+	shared = shared && h.SharedHistory()
+	for {
+		var history int64
+		if shared {
+			history = h.HistoryBytes()
+		}
+		if c.nbytes+history <= c.maxBytes {
+			return
+		}
+		if history > c.maxBytes/2 && h.DropHistory() {
+			continue
+		}
+		if !c.removeOldest() && !(shared && h.DropHistory()) {
+			return
+		}
+	}
+}
+
+// Remove deletes key from the cache and makes the policy forget it,
+// including the LRU-K history.
+func (c *Cache) Remove(key string) {
+	if kv, ok := c.cache[key]; ok {
+		c.removeEntry(kv, EvictRemoved)
 		return
 	}
+	c.policy.Remove(key, EvictRemoved)
+}
 
-	// missed in cache, then check history to incr visited time
-	hEle, ok := c.history[key]
-	if ok {
-		// auto-incr visited count
-		hc = hEle.Value.(historyCounter)
-		hc.time++
-
-		if hc.time >= c.K {
-			// true: removed from history, and add into cache
-			c.deleteFromHistory(key)
-			c.addToCache(key, value)
+// RemoveExpired drops every cached entry whose deadline is before now
+// and returns how many were removed.
+func (c *Cache) RemoveExpired(now time.Time) int {
+	n := 0
+	for _, kv := range c.cache {
+		if kv.expired(now) {
+			c.removeEntry(kv, EvictExpired)
+			n++
 		}
-		// write back to history
-		hEle.Value = hc
-	} else {
-		c.historyReplacingCheck()
-		hc = historyCounter{key: key, time: 1}
-		hEle = c.historyLL.PushFront(hc)
-		c.historyRest--
 	}
-	c.history[key] = hEle
+	return n
 }
 
+// GetNBytes returns the bytes taken by keys and values, plus the history
+// of the policy, whether or not it counts toward maxBytes
 func (c *Cache) GetNBytes() int64 {
-	return c.nbytes
+	return c.nbytes + c.HistoryBytes()
 }
 
 func (c *Cache) GetMaxBytes() int64 {
@@ -165,3 +236,33 @@ func (c *Cache) GetMaxBytes() int64 {
 func (c *Cache) Len() int {
 	return len(c.cache)
 }
+
+// HistoryLen returns the number of keys the policy tracks outside the cache,
+// e.g. the LRU-K history
+func (c *Cache) HistoryLen() int {
+	if h, ok := c.policy.(historyPolicy); ok {
+		return h.HistoryLen()
+	}
+	return 0
+}
+
+// HistoryBytes returns the estimated memory taken by the policy's history
+func (c *Cache) HistoryBytes() int64 {
+	if h, ok := c.policy.(historyPolicy); ok {
+		return h.HistoryBytes()
+	}
+	return 0
+}
+
+// Evictions returns how many entries were dropped for capacity or expiry
+func (c *Cache) Evictions() int64 {
+	return c.nevict
+}
+
+// Promotions returns how many keys moved from the history into the cache
+func (c *Cache) Promotions() int64 {
+	if h, ok := c.policy.(historyPolicy); ok {
+		return h.Promotions()
+	}
+	return 0
+}
@@ -1,8 +1,14 @@
 package lru
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 type String string
@@ -11,31 +17,201 @@ func (d String) Len() int {
 	return len(d)
 }
 
+// policies lists every EvictionPolicy, adds is how many Add calls a new
+// key needs before it is admitted, scan tells if it survives one-off scans
+var policies = []struct {
+	name   string
+	adds   int
+	scan   bool
+	policy func() EvictionPolicy
+}{
+	{"LRU", 1, false, func() EvictionPolicy { return NewLRU() }},
+	{"LRU-K k=1", 1, false, func() EvictionPolicy { return NewLRUK(1, 30) }},
+	{"LRU-K k=2", 2, true, func() EvictionPolicy { return NewLRUK(2, 30) }},
+	{"LFU", 1, true, func() EvictionPolicy { return NewLFU() }},
+	{"ARC", 1, true, func() EvictionPolicy { return NewARC() }},
+	{"2Q", 1, true, func() EvictionPolicy { return NewTwoQueue() }},
+	{"W-TinyLFU", 1, true, func() EvictionPolicy { return NewTinyLFU(100) }},
+}
+
+// add calls Add as many times as the policy needs to admit key
+func add(c *Cache, adds int, key string, value Value) {
+	for i := 0; i < adds; i++ {
+		c.Add(key, value)
+	}
+}
+
 func TestGet(t *testing.T) {
-	t.Run("k=1, unlimited max bytes", func(t *testing.T) {
-		lru := New(1, int64(0), 30, nil)
-		lru.Add("key1", String("1234"))
-		if v, ok := lru.Get("key1"); !ok || string(v.(String)) != "1234" {
-			t.Fatalf("cache hit key1=1234 failed")
-		}
-		if _, ok := lru.Get("key2"); ok {
-			t.Fatalf("cache miss key2 failed")
-		}
-	})
+	for _, p := range policies {
+		t.Run(p.name+", unlimited max bytes", func(t *testing.T) {
+			lru := NewWithPolicy(int64(0), p.policy(), nil)
+			add(lru, p.adds, "key1", String("1234"))
+			if v, ok := lru.Get("key1"); !ok || string(v.(String)) != "1234" {
+				t.Fatalf("cache hit key1=1234 failed")
+			}
+			if _, ok := lru.Get("key2"); ok {
+				t.Fatalf("cache miss key2 failed")
+			}
+		})
 
-	t.Run("k=1, limited max bytes", func(t *testing.T) {
-		lru := New(1, int64(20), 30, nil)
-		lru.Add("key1", String("1234"))
-		lru.Add("key2", String("1234"))
-		lru.Add("key3", String("1234"))
-		if _, ok := lru.Get("key1"); ok {
-			t.Fatalf("cache miss key1 failed")
-		}
-		if v, ok := lru.Get("key2"); !ok || string(v.(String)) != "1234" {
-			t.Fatalf("cache hit key2=1234 failed")
-		}
-	})
+		t.Run(p.name+", limited max bytes", func(t *testing.T) {
+			lru := NewWithPolicy(int64(20), p.policy(), nil)
+			add(lru, p.adds, "key1", String("1234"))
+			add(lru, p.adds, "key2", String("1234"))
+			add(lru, p.adds, "key3", String("1234"))
+			if _, ok := lru.Get("key1"); ok {
+				t.Fatalf("cache miss key1 failed")
+			}
+			if v, ok := lru.Get("key2"); !ok || string(v.(String)) != "1234" {
+				t.Fatalf("cache hit key2=1234 failed")
+			}
+		})
+	}
+}
+
+func TestRemoveOldest(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			k1, k2, k3 := "key1", "key2", "key3"
+			v1, v2, v3 := "value1", "value2", "value3"
+			cap := len(k1 + k2 + v1 + v2)
+			lru := NewWithPolicy(int64(cap), p.policy(), nil)
+			add(lru, p.adds, k1, String(v1))
+			add(lru, p.adds, k2, String(v2))
+			add(lru, p.adds, k3, String(v3))
+
+			if _, ok := lru.Get(k1); ok || lru.Len() != 2 {
+				t.Fatalf("Removeoldest key1 failed")
+			}
+		})
+	}
+}
+
+func TestOnEvicted(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			keys := make([]string, 0)
+			callback := func(key string, value Value, reason EvictReason) {
+				keys = append(keys, key)
+			}
+			lru := NewWithPolicy(int64(10), p.policy(), callback)
+			add(lru, p.adds, "key1", String("123456"))
+			add(lru, p.adds, "k2", String("k2"))
+			add(lru, p.adds, "k3", String("k3"))
+			add(lru, p.adds, "k4", String("k4"))
+			expect := []string{"key1", "k2"}
+
+			if !reflect.DeepEqual(expect, keys) {
+				t.Fatalf("Call OnEvicted failed, expect keys equals to %s, got %s", expect, keys)
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			reasons := make(map[string]EvictReason)
+			callback := func(key string, value Value, reason EvictReason) {
+				reasons[key] = reason
+			}
+			lru := NewWithPolicy(int64(0), p.policy(), callback)
+			for i := 0; i < p.adds; i++ {
+				lru.AddWithExpire("key1", String("1234"), time.Now().Add(-time.Second))
+				lru.AddWithExpire("key2", String("1234"), time.Now().Add(time.Hour))
+			}
+			add(lru, p.adds, "key3", String("1234"))
+
+			if _, ok := lru.Get("key1"); ok {
+				t.Fatalf("expired key1 should miss")
+			}
+			if reasons["key1"] != EvictExpired {
+				t.Fatalf("key1 evicted for %v, expect %v", reasons["key1"], EvictExpired)
+			}
+			if v, ok := lru.Get("key2"); !ok || string(v.(String)) != "1234" {
+				t.Fatalf("cache hit key2=1234 failed")
+			}
+
+			if n := lru.RemoveExpired(time.Now().Add(2 * time.Hour)); n != 1 || lru.Len() != 1 {
+				t.Fatalf("RemoveExpired removed %d, %d left", n, lru.Len())
+			}
+			if _, ok := lru.Get("key3"); !ok {
+				t.Fatalf("key3 without deadline should never expire")
+			}
+			// GetNBytes includes the history the policy keeps of key1
+			if lru.GetNBytes()-lru.HistoryBytes() != int64(len("key3")+len("1234")) {
+				t.Fatalf("nbytes %d not released on expiry", lru.GetNBytes())
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			lru := NewWithPolicy(int64(0), p.policy(), nil)
+			add(lru, p.adds, "key1", String("1234"))
+			lru.Remove("key1")
+
+			if _, ok := lru.Get("key1"); ok || lru.Len() != 0 || lru.GetNBytes() != lru.HistoryBytes() {
+				t.Fatalf("Remove key1 from cache failed")
+			}
+			// the policy must have forgotten key1, so it can be added again
+			add(lru, p.adds, "key1", String("1234"))
+			if _, ok := lru.Get("key1"); !ok {
+				t.Fatalf("key1 should be cached again after Remove")
+			}
+		})
+	}
+}
+
+// TestScanResistance warms the cache up with a few hot keys, then reads
+// them again in between a stream of keys seen only once. Plain LRU loses
+// the hot keys to the scan, the other policies keep them.
+func TestScanResistance(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			lru := NewWithPolicy(int64(12*8), p.policy(), nil) // 12 entries
+			hits, gets, scan := 0, 0, 0
+			access := func(key string, count bool) {
+				_, ok := lru.Get(key)
+				if count {
+					gets++
+					if ok {
+						hits++
+					}
+				}
+				if !ok {
+					lru.Add(key, String("1234"))
+				}
+			}
+			next := func() string {
+				scan++
+				return fmt.Sprintf("s%03d", scan)
+			}
+			for i := 0; i < 40; i++ {
+				access(fmt.Sprintf("h%03d", i%4), false)
+				access(next(), false)
+			}
+			for i := 0; i < 400; i++ {
+				for j := 0; j < 4; j++ {
+					access(next(), false)
+				}
+				access(fmt.Sprintf("h%03d", i%4), true)
+			}
+
+			ratio := float64(hits) / float64(gets)
+			if p.scan && ratio < 0.9 {
+				t.Fatalf("hot keys hit ratio %.2f, expect scan resistance", ratio)
+			}
+			if !p.scan && ratio > 0.1 {
+				t.Fatalf("hot keys hit ratio %.2f, expect the scan to flush them", ratio)
+			}
+		})
+	}
+}
 
+func TestLRUK(t *testing.T) {
 	t.Run("k=2, unlimited max bytes", func(t *testing.T) {
 		lru := New(2, int64(0), 30, nil)
 		lru.Add("key1", String("1234"))
@@ -65,36 +241,150 @@ func TestGet(t *testing.T) {
 			t.Fatalf("cache hit key2=1234 failed")
 		}
 	})
+
+	t.Run("remove from history", func(t *testing.T) {
+		lru := New(2, int64(0), 30, nil)
+		lru.Add("key2", String("1234"))
+		lru.Remove("key2")
+		// key2 was dropped from history, so one more Add must not promote it
+		lru.Add("key2", String("1234"))
+		if _, ok := lru.Get("key2"); ok {
+			t.Fatalf("Remove key2 from history failed")
+		}
+	})
 }
 
-func TestRemoveOldest(t *testing.T) {
-	k1, k2, k3 := "key1", "key2", "key3"
-	v1, v2, v3 := "value1", "value2", "value3"
-	cap := len(k1 + k2 + v1 + v2)
-	lru := New(1, int64(cap), 30, nil)
-	lru.Add(k1, String(v1))
-	lru.Add(k2, String(v2))
-	lru.Add(k3, String(v3))
+func TestLRUKGetMiss(t *testing.T) {
+	lru := New(2, int64(0), 30, nil)
+	// a Get miss and the Add of the loaded value are one reference
+	lru.Get("key1")
+	lru.Add("key1", String("1234"))
+	if _, ok := lru.Get("key1"); ok {
+		t.Fatalf("key1 was referenced once, it should not be cached")
+	}
+	lru.Add("key1", String("1234"))
+	if _, ok := lru.Get("key1"); !ok {
+		t.Fatalf("key1 was referenced twice, it should be cached")
+	}
+}
+
+func TestLRUKHistoryOrder(t *testing.T) {
+	lru := New(2, int64(0), 2, nil)
+	lru.Add("a", String("1234"))
+	lru.Add("b", String("1234"))
+	// referencing a moves it to the front, so c pushes b out instead
+	lru.Get("a")
+	lru.Add("c", String("1234"))
+	lru.Add("a", String("1234"))
+	lru.Add("b", String("1234"))
 
-	if _, ok := lru.Get(k1); ok || lru.Len() != 2 {
-		t.Fatalf("Removeoldest key1 failed")
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatalf("a should be cached on its second reference")
+	}
+	if _, ok := lru.Get("b"); ok {
+		t.Fatalf("b was dropped from the history, it should need two more references")
 	}
 }
 
-func TestOnEvicted(t *testing.T) {
-	keys := make([]string, 0)
-	callback := func(key string, value Value) {
-		keys = append(keys, key)
+func TestLRUKBackwardDistance(t *testing.T) {
+	lru := New(2, int64(24), 30, nil)
+	for _, key := range []string{"a", "a", "b", "b", "c", "c"} {
+		lru.Add(key, String("1234567"))
+	}
+	lru.Get("b")
+	lru.Get("a")
+	lru.Get("a")
+	// plain LRU would evict c, the least recently used, but b has the
+	// oldest second most recent reference
+	lru.Add("d", String("1234567"))
+	lru.Add("d", String("1234567"))
+
+	if _, ok := lru.Get("b"); ok {
+		t.Fatalf("b has the largest backward 2-distance, it should be evicted")
+	}
+	if _, ok := lru.Get("c"); !ok {
+		t.Fatalf("c should stay")
+	}
+	// b kept its references in the history, one more is enough
+	lru.Add("b", String("1234567"))
+	if _, ok := lru.Get("b"); !ok {
+		t.Fatalf("evicted b should be admitted again on its next reference")
+	}
+}
+
+func TestLRUKCorrelatedPeriod(t *testing.T) {
+	now := time.Now()
+	policy := NewLRUKWithConfig(LRUKConfig{K: 2, HistoryMax: 30, CorrelatedPeriod: time.Minute})
+	policy.now = func() time.Time { return now }
+	lru := NewWithPolicy(int64(0), policy, nil)
+
+	lru.Add("key1", String("1234"))
+	lru.Add("key1", String("1234"))
+	if lru.Len() != 0 {
+		t.Fatalf("references within the period should count once")
+	}
+	now = now.Add(2 * time.Minute)
+	lru.Add("key1", String("1234"))
+	if lru.Len() != 1 {
+		t.Fatalf("a reference after the period should count")
+	}
+}
+
+func TestLRUKHistoryBytes(t *testing.T) {
+	entry := int64(len("key0")) + 2*8 + historyEntryOverhead
+	lru := NewWithPolicy(int64(0), NewLRUKWithConfig(LRUKConfig{K: 2, HistoryBytes: 3 * entry}), nil)
+	for i := 0; i < 10; i++ {
+		lru.Add(fmt.Sprintf("key%d", i), String("1234"))
+	}
+	if lru.HistoryLen() != 3 || lru.HistoryBytes() != 3*entry || lru.GetNBytes() != 3*entry {
+		t.Fatalf("history len=%d bytes=%d nbytes=%d, expect 3 %d %d",
+			lru.HistoryLen(), lru.HistoryBytes(), lru.GetNBytes(), 3*entry, 3*entry)
+	}
+	// a key larger than the budget is never remembered
+	long := string(make([]byte, 1000))
+	lru.Add(long, String("1234"))
+	lru.Add(long, String("1234"))
+	if _, ok := lru.Get(long); ok || lru.HistoryBytes() > 3*entry {
+		t.Fatalf("long key should not fit the history, history bytes %d", lru.HistoryBytes())
+	}
+}
+
+func TestLRUKHashKeys(t *testing.T) {
+	lru := NewWithPolicy(int64(0), NewLRUKWithConfig(LRUKConfig{K: 2, HashKeys: true}), nil)
+	for i := 0; i < 3; i++ {
+		lru.Add(fmt.Sprintf("%01000d", i), String("1234"))
+	}
+	// the history keeps 8 byte hashes, not the 1000 byte keys
+	if entry := int64(2*8 + historyEntryOverhead); lru.HistoryBytes() != 3*entry {
+		t.Fatalf("history bytes %d, expect %d", lru.HistoryBytes(), 3*entry)
+	}
+	key := fmt.Sprintf("%01000d", 1)
+	lru.Add(key, String("1234"))
+	if v, ok := lru.Get(key); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("hashed history should admit the key on its second reference")
+	}
+	if lru.HistoryLen() != 2 {
+		t.Fatalf("history len %d, expect 2", lru.HistoryLen())
 	}
-	lru := New(1, int64(10), 30, callback)
-	lru.Add("key1", String("123456"))
-	lru.Add("k2", String("k2"))
-	lru.Add("k3", String("k3"))
-	lru.Add("k4", String("k4"))
-	expect := []string{"key1", "k2"}
+}
 
-	if !reflect.DeepEqual(expect, keys) {
-		t.Fatalf("Call OnEvicted failed, expect keys equals to %s", expect)
+func TestLRUKSharedHistory(t *testing.T) {
+	const maxBytes = 1000
+	value := String(make([]byte, 100))
+	lru := NewWithPolicy(int64(maxBytes), NewLRUKWithConfig(LRUKConfig{K: 2, SharedHistory: true}), nil)
+	for _, key := range []string{"a", "a", "b", "b"} {
+		lru.Add(key, value)
+	}
+	// a flood of keys seen once fills the history, which has to make room
+	// within maxBytes next to a and b
+	for i := 0; i < 100; i++ {
+		lru.Get(fmt.Sprintf("key%d", i))
+		if lru.GetNBytes() > maxBytes {
+			t.Fatalf("cache and history take %d bytes, over %d", lru.GetNBytes(), maxBytes)
+		}
+	}
+	if lru.Len() != 2 || lru.HistoryLen() == 0 {
+		t.Fatalf("len=%d history len=%d bytes=%d", lru.Len(), lru.HistoryLen(), lru.HistoryBytes())
 	}
 }
 
@@ -115,3 +405,341 @@ func TestDeleteHistory(t *testing.T) {
 		}
 	})
 }
+
+func TestCounters(t *testing.T) {
+	lru := New(2, int64(20), 30, nil)
+	lru.Add("key1", String("1234"))
+	lru.Add("key1", String("1234"))
+	lru.Add("key2", String("1234"))
+	lru.Add("key2", String("1234"))
+	lru.Add("key3", String("1234"))
+	lru.Add("key3", String("1234"))
+	lru.Add("key4", String("1234"))
+
+	// the evicted key1 keeps its references in the history next to key4
+	if lru.Promotions() != 3 || lru.Evictions() != 1 || lru.HistoryLen() != 2 {
+		t.Fatalf("promotions=%d evictions=%d history=%d, expect 3 1 2",
+			lru.Promotions(), lru.Evictions(), lru.HistoryLen())
+	}
+	lru.Remove("key3")
+	if lru.Evictions() != 1 {
+		t.Fatalf("explicit Remove should not count as eviction")
+	}
+}
+
+func TestLFU(t *testing.T) {
+	lru := NewWithPolicy(int64(24), NewLFU(), nil)
+	lru.Add("key1", String("1234"))
+	lru.Add("key2", String("1234"))
+	lru.Add("key3", String("1234"))
+	lru.Get("key1")
+	lru.Get("key1")
+	lru.Get("key3")
+	lru.Add("key4", String("1234"))
+
+	if _, ok := lru.Get("key2"); ok {
+		t.Fatalf("the least frequently used key2 should be evicted")
+	}
+	if _, ok := lru.Get("key1"); !ok {
+		t.Fatalf("the most frequently used key1 should stay")
+	}
+}
+
+// zipfTrace returns n keys drawn from a Zipfian distribution over
+// distinct keys, the usual shape of cache traffic
+func zipfTrace(n int, distinct uint64, seed int64) []string {
+	r := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(r, 1.01, 1, distinct-1)
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = strconv.FormatUint(z.Uint64(), 10)
+	}
+	return trace
+}
+
+// hitRatio replays trace against c the way Group uses it, loading and
+// adding the value after every miss
+func hitRatio(c *Cache, trace []string) float64 {
+	hits := 0
+	for _, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+			continue
+		}
+		c.Add(key, String("1234"))
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func TestSketch(t *testing.T) {
+	s := newCMSketch(100)
+	for i := 0; i < 5; i++ {
+		s.increment("hot")
+	}
+	s.increment("cold")
+	if s.estimate("hot") != 5 || s.estimate("cold") != 1 || s.estimate("none") != 0 {
+		t.Fatalf("estimates hot=%d cold=%d none=%d", s.estimate("hot"), s.estimate("cold"), s.estimate("none"))
+	}
+	for i := 0; i < 20; i++ {
+		s.increment("hot")
+	}
+	if s.estimate("hot") != 15 {
+		t.Fatalf("counters should saturate at 15, got %d", s.estimate("hot"))
+	}
+	s.reset()
+	if s.estimate("hot") != 7 || s.estimate("cold") != 0 {
+		t.Fatalf("reset should halve counters, hot=%d cold=%d", s.estimate("hot"), s.estimate("cold"))
+	}
+}
+
+func TestTinyLFUZipf(t *testing.T) {
+	trace := zipfTrace(100000, 10000, 1)
+	size := int64(500 * 8)
+	lruk := hitRatio(New(2, size, 500, nil), trace)
+	tiny := hitRatio(NewWithPolicy(size, NewTinyLFU(500), nil), trace)
+	if tiny <= lruk {
+		t.Fatalf("W-TinyLFU hit ratio %.3f, LRU-K %.3f", tiny, lruk)
+	}
+}
+
+// BenchmarkZipf reports the hit ratio of every policy on the same
+// Zipfian trace, with a cache holding 1% and 5% of the distinct keys.
+func BenchmarkZipf(b *testing.B) {
+	const distinct = 100000
+	trace := zipfTrace(1000000, distinct, 1)
+	for _, items := range []int{distinct / 100, distinct / 20} {
+		for _, p := range policies {
+			policy := p.policy
+			if p.name == "W-TinyLFU" {
+				policy = func() EvictionPolicy { return NewTinyLFU(items) }
+			}
+			b.Run(fmt.Sprintf("%s/items=%d", p.name, items), func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = hitRatio(NewWithPolicy(int64(items*10), policy(), nil), trace)
+				}
+				b.ReportMetric(ratio*100, "hit%")
+			})
+		}
+	}
+}
+
+func TestCost(t *testing.T) {
+	lru := NewWithPolicy(int64(30), NewLRU(), nil)
+	lru.SetCost(func(key string, value Value) int64 { return 10 })
+	for i := 0; i < 4; i++ {
+		lru.Add(fmt.Sprintf("key%d", i), String("1234"))
+	}
+	if lru.Len() != 3 || lru.GetNBytes() != 30 {
+		t.Fatalf("len=%d nbytes=%d, expect 3 entries of cost 10", lru.Len(), lru.GetNBytes())
+	}
+	// an explicit cost wins over the CostFunc
+	lru.AddWithCost("big", String("1234"), time.Time{}, 25)
+	if lru.Len() != 1 || lru.GetNBytes() != 25 {
+		t.Fatalf("len=%d nbytes=%d, big should have pushed the others out", lru.Len(), lru.GetNBytes())
+	}
+	lru.Remove("big")
+	if lru.GetNBytes() != 0 {
+		t.Fatalf("nbytes %d after removing big", lru.GetNBytes())
+	}
+
+	c := NewConcurrent(int64(30), NewLRU(), nil)
+	c.SetCost(EstimatedCost)
+	c.AddWithCost("key", String("1234"), time.Time{}, 20)
+	c.AddWithCost("key", String("1234"), time.Time{}, 0)
+	if c.Len() != 0 || c.GetNBytes() != 0 {
+		t.Fatalf("an estimated %d bytes entry should not fit in 30", EstimatedCost("key", String("1234")))
+	}
+}
+
+// TestMemoryBudget fills caches of every policy far beyond maxBytes and
+// checks with runtime.MemStats that EstimatedCost keeps the heap they
+// take close to maxBytes. Ghost keys of ARC and 2Q and rounding to size
+// classes are not charged, so some slack is allowed above.
+func TestMemoryBudget(t *testing.T) {
+	const maxBytes = 4 << 20
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			lru := NewWithPolicy(maxBytes, p.policy(), nil)
+			lru.SetCost(EstimatedCost)
+			for i := 0; i < 100000; i++ {
+				key := fmt.Sprintf("key%08d", i)
+				value := String(make([]byte, 100))
+				for j := 0; j < p.adds; j++ {
+					lru.Add(key, value)
+				}
+			}
+
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			used := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+			if ratio := float64(used) / maxBytes; ratio < 0.5 || ratio > 1.6 {
+				t.Fatalf("cache of %d entries takes %d bytes of heap, %.2f of maxBytes", lru.Len(), used, ratio)
+			}
+			runtime.KeepAlive(lru)
+		})
+	}
+}
+
+func TestItemsRestore(t *testing.T) {
+	c := New(2, int64(0), 30, nil)
+	for _, key := range []string{"a", "a", "b", "b", "c", "c", "h"} {
+		c.Add(key, String("1234567"))
+	}
+	c.Get("a")
+	items := c.Items()
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	// history first, then least recently used first
+	if !reflect.DeepEqual(keys, []string{"h", "b", "c", "a"}) {
+		t.Fatalf("items in order %v", keys)
+	}
+	if items[0].Value != nil || len(items[0].Refs) != 2 || items[0].Refs[1] != 0 {
+		t.Fatalf("history key h should have one reference, %+v", items[0])
+	}
+
+	r := New(2, int64(24), 30, nil)
+	r.Restore(items)
+	if got := r.Items(); !reflect.DeepEqual(got, items) {
+		t.Fatalf("restored %+v, want %+v", got, items)
+	}
+	// a has the largest backward 2-distance, as before the restore
+	if victim, _ := r.policy.Victim(); victim != "a" {
+		t.Fatalf("a should be the next victim, got %s", victim)
+	}
+	// h kept its reference, one more admits it
+	r.Add("h", String("1234567"))
+	if _, ok := r.Get("h"); !ok {
+		t.Fatalf("h should be admitted on its second reference")
+	}
+
+	cc := NewConcurrent(int64(0), NewLRUK(2, 30), nil)
+	cc.Restore(items)
+	if got := cc.Items(); !reflect.DeepEqual(got, items) {
+		t.Fatalf("concurrent cache restored %+v, want %+v", got, items)
+	}
+}
+
+func TestConcurrentCache(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			evicted := make([]string, 0)
+			c := NewConcurrent(int64(20), p.policy(), func(key string, value Value, reason EvictReason) {
+				evicted = append(evicted, key)
+			})
+			for _, key := range []string{"key1", "key2", "key3"} {
+				for i := 0; i < p.adds; i++ {
+					c.Add(key, String("1234"))
+				}
+			}
+			if _, ok := c.Get("key1"); ok || !reflect.DeepEqual(evicted, []string{"key1"}) {
+				t.Fatalf("key1 should be evicted, evicted %v", evicted)
+			}
+			if v, ok := c.Get("key2"); !ok || string(v.(String)) != "1234" {
+				t.Fatalf("cache hit key2=1234 failed")
+			}
+			c.Remove("key2")
+			if _, ok := c.Get("key2"); ok || c.Len() != 1 || c.GetNBytes()-c.HistoryBytes() != 8 {
+				t.Fatalf("Remove key2 failed, len=%d nbytes=%d", c.Len(), c.GetNBytes())
+			}
+			for i := 0; i < p.adds; i++ {
+				c.AddWithExpire("key4", String("1234"), time.Now().Add(-time.Second))
+			}
+			if _, ok := c.Get("key4"); ok || c.Len() != 1 || c.Evictions() != 2 {
+				t.Fatalf("expired key4 should miss, len=%d evictions=%d", c.Len(), c.Evictions())
+			}
+		})
+	}
+}
+
+func TestConcurrentCacheRecency(t *testing.T) {
+	c := NewConcurrent(int64(16), NewLRU(), nil)
+	c.Add("key1", String("1234"))
+	c.Add("key2", String("1234"))
+	// rings live in a sync.Pool, which may drop them (always under -race),
+	// so hand over a full ring directly, the next write drains it
+	c.pending <- []access{{key: "key1", hit: true}}
+	c.Add("key3", String("1234"))
+	if _, ok := c.Get("key1"); !ok {
+		t.Fatalf("recently read key1 should stay")
+	}
+	if _, ok := c.Get("key2"); ok {
+		t.Fatalf("key2 should be evicted")
+	}
+}
+
+func TestConcurrentCacheParallel(t *testing.T) {
+	c := NewConcurrent(int64(50*8), NewTinyLFU(100), nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 5000; i++ {
+				key := strconv.Itoa(r.Intn(100) + 100)
+				switch n := r.Intn(10); {
+				case n == 0:
+					c.Remove(key)
+				case n < 4:
+					c.Add(key, String("1234"))
+				default:
+					if v, ok := c.Get(key); ok && string(v.(String)) != "1234" {
+						t.Errorf("got %v for %s", v, key)
+					}
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	n, nbytes := 0, int64(0)
+	c.items.Range(func(k, v interface{}) bool {
+		n++
+		nbytes += int64(len(k.(string)) + v.(*entry).value.Len())
+		return true
+	})
+	if n != c.Len() || nbytes != c.GetNBytes() || nbytes > c.GetMaxBytes() {
+		t.Fatalf("len=%d/%d nbytes=%d/%d", n, c.Len(), nbytes, c.GetNBytes())
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	b.Run("Cache+Mutex", func(b *testing.B) {
+		var mu sync.Mutex
+		c := NewWithPolicy(0, NewLRU(), nil)
+		for _, key := range keys {
+			c.Add(key, String("1234"))
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				mu.Lock()
+				c.Get(keys[i%len(keys)])
+				mu.Unlock()
+			}
+		})
+	})
+	b.Run("ConcurrentCache", func(b *testing.B) {
+		c := NewConcurrent(0, NewLRU(), nil)
+		for _, key := range keys {
+			c.Add(key, String("1234"))
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				c.Get(keys[i%len(keys)])
+			}
+		})
+	})
+}
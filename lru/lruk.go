@@ -0,0 +1,405 @@
+package lru
+
+import (
+	"container/heap"
+	"container/list"
+	"time"
+)
+
+// LRUK is the LRU-K policy (O'Neil, O'Neil and Weikum). Every key it has
+// seen recently, cached or not, keeps the times of its K most recent
+// references, recorded by Get misses, Adds and hits alike. A key is only
+// admitted once it has K references, and the cached key with the oldest
+// K-th reference, i.e. the largest backward K-distance, is evicted first.
+// Keys with fewer than K references have an infinite distance and go
+// first, in LRU order.
+//
+// References to a key within the correlated reference period of the
+// previous one are collapsed into a single reference, so a burst of
+// requests is not mistaken for popularity. Keys not cached, including
+// evicted ones, are remembered in a history list ordered by their last
+// reference and bounded by a key count and a byte budget.
+type LRUK struct {
+	K          int           // LRU-K
+	crp        time.Duration // correlated reference period, 0 means every reference counts
+	now        func() time.Time
+	tick       uint64 // logical clock ordering the references
+	cached     map[string]*lrukEntry
+	cache      lrukHeap   // cached keys by their K-th reference
+	history    *list.List // 存放历史记录，最近访问的在前
+	byKey      map[string]*lrukEntry
+	byHash     map[uint64]*lrukEntry // history by key hash, with HashKeys
+	historyMax int
+	maxBytes   int64 // byte budget of the history, 0 means no limit
+	nbytes     int64 // bytes taken by the history
+	shared     bool
+	npromote   int64 // keys promoted from history to cache
+}
+
+// LRUKConfig configures an LRU-K policy created by NewLRUKWithConfig
+type LRUKConfig struct {
+	K                int           // references needed for admission, <= 1 behaves as plain LRU
+	HistoryMax       int           // keys kept in the history, 0 means no limit on the count
+	HistoryBytes     int64         // bytes the history may take, 0 means no limit on the size
+	SharedHistory    bool          // history bytes also count toward the Cache's maxBytes
+	HashKeys         bool          // keep 64-bit key hashes in the history instead of the keys
+	CorrelatedPeriod time.Duration // references closer than this count as one
+}
+
+// lrukEntry is the reference history of one key
+type lrukEntry struct {
+	key     string // empty for a hashed history entry
+	hash    uint64
+	hist    []uint64  // ticks of the K most recent uncorrelated references, hist[0] is the latest
+	last    time.Time // time of the latest reference, for the correlated reference period
+	pending bool      // a Get miss was counted, the Add of the loaded value is the same reference
+	index   int       // position in cache, -1 when not cached
+	ele     *list.Element
+}
+
+// historyEntryOverhead roughly estimates the memory of a history entry
+// besides its key and ticks: the lrukEntry, its list element and map slot
+const historyEntryOverhead = 128
+
+// historyBytes estimates the memory of e as a history entry
+func (e *lrukEntry) historyBytes() int64 {
+	return int64(len(e.key)) + 8*int64(len(e.hist)) + historyEntryOverhead
+}
+
+// kth returns the tick of the K-th most recent reference, 0 if there were fewer
+func (e *lrukEntry) kth() uint64 {
+	return e.hist[len(e.hist)-1]
+}
+
+// lrukHeap is a min-heap of cached keys ordered by their K-th reference,
+// then by their latest one
+type lrukHeap []*lrukEntry
+
+func (h lrukHeap) Len() int { return len(h) }
+func (h lrukHeap) Less(i, j int) bool {
+	if h[i].kth() != h[j].kth() {
+		return h[i].kth() < h[j].kth()
+	}
+	return h[i].hist[0] < h[j].hist[0]
+}
+func (h lrukHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lrukHeap) Push(x interface{}) {
+	e := x.(*lrukEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lrukHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	e.index = -1
+	return e
+}
+
+// NewLRUK creates an LRU-K policy in which every reference counts and
+// the history holds at most historyMax keys, k <= 1 behaves as plain LRU
+func NewLRUK(k, historyMax int) *LRUK {
+	return NewLRUKWithConfig(LRUKConfig{K: k, HistoryMax: historyMax})
+}
+
+// NewLRUKWithConfig creates an LRU-K policy as configured by cfg. With
+// neither HistoryMax nor HistoryBytes the history is unbounded.
+func NewLRUKWithConfig(cfg LRUKConfig) *LRUK {
+	p := &LRUK{
+		K:          cfg.K,
+		crp:        cfg.CorrelatedPeriod,
+		now:        time.Now,
+		cached:     make(map[string]*lrukEntry),
+		history:    list.New(),
+		historyMax: cfg.HistoryMax,
+		maxBytes:   cfg.HistoryBytes,
+		shared:     cfg.SharedHistory,
+	}
+	if p.K < 1 {
+		p.K = 1
+	}
+	if cfg.HashKeys {
+		p.byHash = make(map[uint64]*lrukEntry)
+	} else {
+		p.byKey = make(map[string]*lrukEntry)
+	}
+	return p
+}
+
+// reference records a reference to e now
+func (p *LRUK) reference(e *lrukEntry) {
+	if p.crp > 0 {
+		now := p.now()
+		correlated := !e.last.IsZero() && now.Sub(e.last) <= p.crp
+		e.last = now
+		if correlated {
+			return
+		}
+	}
+	p.tick++
+	copy(e.hist[1:], e.hist[:len(e.hist)-1])
+	e.hist[0] = p.tick
+	if e.index >= 0 {
+		heap.Fix(&p.cache, e.index)
+	} else if e.ele != nil {
+		p.history.MoveToFront(e.ele)
+	}
+}
+
+// lookup returns the entry of key, cached or in the history
+func (p *LRUK) lookup(key string) *lrukEntry {
+	if e, ok := p.cached[key]; ok {
+		return e
+	}
+	if p.byHash != nil {
+		return p.byHash[keyHash(key)]
+	}
+	return p.byKey[key]
+}
+
+// track returns the entry of key, creating it in the history if needed
+func (p *LRUK) track(key string) *lrukEntry {
+	if e := p.lookup(key); e != nil {
+		return e
+	}
+	e := &lrukEntry{key: key, hist: make([]uint64, p.K), index: -1}
+	p.pushHistory(e)
+	return e
+}
+
+// pushHistory puts e in front of the history, dropping the least recently
+// referenced keys beyond historyMax and the byte budget
+func (p *LRUK) pushHistory(e *lrukEntry) {
+	if p.byHash != nil {
+		e.hash = keyHash(e.key)
+		e.key = ""
+		if old, ok := p.byHash[e.hash]; ok {
+			// a colliding key shares the slot, the newer one wins
+			p.deleteFromHistory(old)
+		}
+		p.byHash[e.hash] = e
+	} else {
+		p.byKey[e.key] = e
+	}
+	e.ele = p.history.PushFront(e)
+	p.nbytes += e.historyBytes()
+	for p.history.Len() > 0 && (p.historyMax > 0 && p.history.Len() > p.historyMax ||
+		p.maxBytes > 0 && p.nbytes > p.maxBytes) {
+		p.DropHistory()
+	}
+}
+
+func (p *LRUK) deleteFromHistory(e *lrukEntry) {
+	if e.ele == nil {
+		return
+	}
+	p.history.Remove(e.ele)
+	e.ele = nil
+	p.nbytes -= e.historyBytes()
+	if p.byHash != nil {
+		delete(p.byHash, e.hash)
+	} else {
+		delete(p.byKey, e.key)
+	}
+}
+
+// DropHistory forgets the least recently referenced key of the history,
+// false if the history is empty
+func (p *LRUK) DropHistory() bool {
+	tail := p.history.Back()
+	if tail == nil {
+		return false
+	}
+	p.deleteFromHistory(tail.Value.(*lrukEntry))
+	return true
+}
+
+// Admit counts a reference and lets key in once it has K of them
+func (p *LRUK) Admit(key string) bool {
+	// special case: LRU, nothing to remember
+	if p.K <= 1 {
+		return true
+	}
+	e := p.track(key)
+	if e.pending {
+		e.pending = false
+	} else {
+		p.reference(e)
+	}
+	if e.ele == nil || e.kth() == 0 {
+		// dropped from a full history right away, or fewer than K references
+		return false
+	}
+	p.deleteFromHistory(e)
+	e.key = key // a hashed entry gets its key back
+	p.cached[key] = e
+	p.npromote++
+	return true
+}
+
+// Add caches key, Admit has already counted the reference
+func (p *LRUK) Add(key string) {
+	e, ok := p.cached[key]
+	if !ok {
+		if e = p.lookup(key); e != nil {
+			// added without Admit, e.g. by Cache.Restore
+			p.deleteFromHistory(e)
+			e.key = key
+		} else {
+			e = &lrukEntry{key: key, hist: make([]uint64, p.K), index: -1}
+		}
+		p.cached[key] = e
+		p.reference(e)
+	}
+	if e.index < 0 {
+		heap.Push(&p.cache, e)
+	}
+}
+
+func (p *LRUK) Hit(key string) {
+	if e, ok := p.cached[key]; ok && e.index >= 0 {
+		p.reference(e)
+	}
+}
+
+// Miss counts the reference of a Get that found nothing, the Add that
+// usually follows with the loaded value does not count again
+func (p *LRUK) Miss(key string) {
+	if p.K <= 1 {
+		return
+	}
+	e := p.track(key)
+	if e.index >= 0 || e.ele == nil {
+		return
+	}
+	p.reference(e)
+	e.pending = true
+}
+
+// Victim returns the cached key with the largest backward K-distance,
+// skipping keys still within their correlated reference period
+func (p *LRUK) Victim() (string, bool) {
+	if len(p.cache) == 0 {
+		return "", false
+	}
+	if p.crp <= 0 || p.eligible(p.cache[0]) {
+		return p.cache[0].key, true
+	}
+	var victim *lrukEntry
+	for _, e := range p.cache {
+		if p.eligible(e) && (victim == nil || e.kth() < victim.kth() ||
+			e.kth() == victim.kth() && e.hist[0] < victim.hist[0]) {
+			victim = e
+		}
+	}
+	if victim == nil {
+		// everything was referenced just now, fall back to the heap order
+		victim = p.cache[0]
+	}
+	return victim.key, true
+}
+
+func (p *LRUK) eligible(e *lrukEntry) bool {
+	return p.now().Sub(e.last) > p.crp
+}
+
+// Remove forgets key after an explicit Remove. A key evicted for
+// capacity or expiry keeps its references in the history, so it is
+// admitted again on its next reference.
+func (p *LRUK) Remove(key string, reason EvictReason) {
+	e, ok := p.cached[key]
+	if ok {
+		delete(p.cached, key)
+		if e.index >= 0 {
+			heap.Remove(&p.cache, e.index)
+		}
+		if reason != EvictRemoved && p.K > 1 {
+			p.pushHistory(e)
+		}
+		return
+	}
+	if reason == EvictRemoved {
+		if e := p.lookup(key); e != nil {
+			p.deleteFromHistory(e)
+		}
+	}
+}
+
+// References returns the ticks of the latest references to key, most
+// recent first
+func (p *LRUK) References(key string) []uint64 {
+	e := p.lookup(key)
+	if e == nil {
+		return nil
+	}
+	return append([]uint64(nil), e.hist...)
+}
+
+// SetReferences replaces the references of key, tracking it in the
+// history if it is not cached. The clock moves past the latest of them.
+func (p *LRUK) SetReferences(key string, refs []uint64) {
+	e := p.lookup(key)
+	if e == nil {
+		if p.K <= 1 {
+			return
+		}
+		e = p.track(key)
+		if e.ele == nil {
+			return
+		}
+	}
+	for i := range e.hist {
+		e.hist[i] = 0
+		if i < len(refs) {
+			e.hist[i] = refs[i]
+			if refs[i] > p.tick {
+				p.tick = refs[i]
+			}
+		}
+	}
+	if e.index >= 0 {
+		heap.Fix(&p.cache, e.index)
+	} else if e.ele != nil {
+		p.history.MoveToFront(e.ele)
+	}
+}
+
+// HistoryKeys returns the keys of the history, least recently referenced
+// first. Hashed entries are left out, their keys are unknown.
+func (p *LRUK) HistoryKeys() []string {
+	keys := make([]string, 0, p.history.Len())
+	for ele := p.history.Back(); ele != nil; ele = ele.Prev() {
+		if e := ele.Value.(*lrukEntry); e.key != "" {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// HistoryLen returns the number of keys remembered outside the cache
+func (p *LRUK) HistoryLen() int {
+	return p.history.Len()
+}
+
+// HistoryBytes returns the estimated memory taken by the history
+func (p *LRUK) HistoryBytes() int64 {
+	return p.nbytes
+}
+
+// SharedHistory tells if the history bytes count toward the Cache's maxBytes
+func (p *LRUK) SharedHistory() bool {
+	return p.shared
+}
+
+// Promotions returns how many keys reached K references and moved from history to cache
+func (p *LRUK) Promotions() int64 {
+	return p.npromote
+}
+
+var _ EvictionPolicy = (*LRUK)(nil)
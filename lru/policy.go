@@ -0,0 +1,145 @@
+package lru
+
+import "container/list"
+
+// EvictionPolicy decides which keys enter a Cache and which key leaves
+// first when the Cache is over maxBytes. It only deals with keys, the
+// Cache keeps the values. A policy is not safe for concurrent use, the
+// Cache calls it under its own synchronization.
+type EvictionPolicy interface {
+	// Admit is asked before a new key enters the cache, false keeps it out.
+	Admit(key string) bool
+	// Add records that key entered the cache.
+	Add(key string)
+	// Hit records an access to a cached key.
+	Hit(key string)
+	// Miss records a lookup of a key that is not cached.
+	Miss(key string)
+	// Victim returns the cached key to evict next.
+	Victim() (key string, ok bool)
+	// Remove forgets key after it left the cache for reason. It may be
+	// called for keys that were never added, to drop any history of them.
+	Remove(key string, reason EvictReason)
+}
+
+// historyPolicy is implemented by policies that remember keys which are
+// not in the cache, e.g. the LRU-K history.
+type historyPolicy interface {
+	HistoryLen() int
+	HistoryBytes() int64
+	// SharedHistory tells if HistoryBytes count toward the Cache's maxBytes.
+	SharedHistory() bool
+	// DropHistory forgets the least recently seen key, false if there is none.
+	DropHistory() bool
+	Promotions() int64
+}
+
+// referencePolicy is implemented by policies whose reference history is
+// worth saving along with the cached values, i.e. LRUK
+type referencePolicy interface {
+	// References returns the logical times of the latest references to
+	// key, most recent first, nil if the key is unknown.
+	References(key string) []uint64
+	// SetReferences replaces them, remembering key in the history if it
+	// is not cached.
+	SetReferences(key string, refs []uint64)
+	// HistoryKeys returns the keys remembered outside the cache, least
+	// recently referenced first.
+	HistoryKeys() []string
+}
+
+// lruList is a recency ordered list of keys, Front is the most recent
+type lruList struct {
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lruList) pushFront(key string) {
+	l.items[key] = l.ll.PushFront(key)
+}
+
+func (l *lruList) moveToFront(key string) bool {
+	ele, ok := l.items[key]
+	if ok {
+		l.ll.MoveToFront(ele)
+	}
+	return ok
+}
+
+func (l *lruList) remove(key string) bool {
+	ele, ok := l.items[key]
+	if ok {
+		l.ll.Remove(ele)
+		delete(l.items, key)
+	}
+	return ok
+}
+
+func (l *lruList) contains(key string) bool {
+	_, ok := l.items[key]
+	return ok
+}
+
+// back returns the least recent key
+func (l *lruList) back() (string, bool) {
+	if ele := l.ll.Back(); ele != nil {
+		return ele.Value.(string), true
+	}
+	return "", false
+}
+
+// popBack removes and returns the least recent key
+func (l *lruList) popBack() (string, bool) {
+	key, ok := l.back()
+	if ok {
+		l.remove(key)
+	}
+	return key, ok
+}
+
+func (l *lruList) len() int {
+	return l.ll.Len()
+}
+
+// LRU evicts the least recently used key.
+type LRU struct {
+	keys *lruList
+}
+
+// NewLRU creates a plain LRU policy
+func NewLRU() *LRU {
+	return &LRU{keys: newLRUList()}
+}
+
+func (p *LRU) Admit(key string) bool { return true }
+func (p *LRU) Add(key string)        { p.keys.pushFront(key) }
+func (p *LRU) Hit(key string)        { p.keys.moveToFront(key) }
+func (p *LRU) Miss(key string)       {}
+
+func (p *LRU) Victim() (string, bool) {
+	return p.keys.back()
+}
+
+func (p *LRU) Remove(key string, reason EvictReason) {
+	p.keys.remove(key)
+}
+
+var _ EvictionPolicy = (*LRU)(nil)
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,86 @@
+package lru
+
+import "hash/fnv"
+
+// cmSketch is a count-min sketch estimating how often keys were seen,
+// with 4-bit counters that are halved every sampleSize increments so
+// that old popularity fades (the "reset" of TinyLFU).
+type cmSketch struct {
+	rows       [cmDepth][]byte // two 4-bit counters per byte
+	mask       uint64          // width-1, width is a power of two
+	additions  int
+	sampleSize int
+}
+
+const cmDepth = 4
+
+// seeds give each row its own hash function
+var cmSeeds = [cmDepth]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// newCMSketch creates a sketch sized for about n distinct keys
+func newCMSketch(n int) *cmSketch {
+	width := uint64(16)
+	for width < uint64(n) {
+		width <<= 1
+	}
+	s := &cmSketch{mask: width - 1, sampleSize: 10 * int(width)}
+	for i := range s.rows {
+		s.rows[i] = make([]byte, width/2)
+	}
+	return s
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// index returns the counter of row i for hash h
+func (s *cmSketch) index(i int, h uint64) uint64 {
+	h ^= cmSeeds[i]
+	h *= 0x9e3779b97f4a7c15
+	h ^= h >> 32
+	return h & s.mask
+}
+
+func (s *cmSketch) get(row []byte, n uint64) byte {
+	return (row[n/2] >> ((n & 1) * 4)) & 0x0f
+}
+
+// increment counts one more occurrence of key
+func (s *cmSketch) increment(key string) {
+	h := keyHash(key)
+	for i := range s.rows {
+		n := s.index(i, h)
+		if s.get(s.rows[i], n) < 15 {
+			s.rows[i][n/2] += 1 << ((n & 1) * 4)
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+// estimate returns the smallest counter of key, an upper bound of its frequency
+func (s *cmSketch) estimate(key string) byte {
+	h := keyHash(key)
+	min := byte(15)
+	for i := range s.rows {
+		if v := s.get(s.rows[i], s.index(i, h)); v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// reset halves every counter
+func (s *cmSketch) reset() {
+	for _, row := range s.rows {
+		for j := range row {
+			row[j] = (row[j] >> 1) & 0x77
+		}
+	}
+	s.additions /= 2
+}
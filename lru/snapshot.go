@@ -0,0 +1,141 @@
+package lru
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// An Item is a cached entry or a key of the policy's history, as listed
+// by Items and put back by Restore
+type Item struct {
+	Key    string
+	Value  Value // nil for a key only remembered by the history
+	Expire time.Time
+	Refs   []uint64 // logical times of the latest references, nil unless the policy is LRUK
+}
+
+// sortByAccess orders entries least recently used first
+func sortByAccess(entries []*entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].access < entries[j].access
+	})
+}
+
+// listItems returns the history keys of policy, then entries, both least
+// recently used first
+func listItems(policy EvictionPolicy, entries []*entry) []Item {
+	sortByAccess(entries)
+	rp, _ := policy.(referencePolicy)
+	var items []Item
+	if rp != nil {
+		for _, key := range rp.HistoryKeys() {
+			items = append(items, Item{Key: key, Refs: rp.References(key)})
+		}
+	}
+	for _, kv := range entries {
+		item := Item{Key: kv.key, Value: kv.value, Expire: kv.expire}
+		if rp != nil {
+			item.Refs = rp.References(kv.key)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Items returns the keys of the LRU-K history, then the cached entries,
+// each least recently used first, so that Restore puts them back in the
+// same order.
+func (c *Cache) Items() []Item {
+	entries := make([]*entry, 0, len(c.cache))
+	for _, kv := range c.cache {
+		entries = append(entries, kv)
+	}
+	return listItems(c.policy, entries)
+}
+
+// Restore adds items in order, the way Items listed them. Entries are
+// cached without asking the policy for admission, expired ones are
+// skipped, and the policy gets their references back. It is meant for an
+// empty Cache, e.g. when warming up after a restart.
+func (c *Cache) Restore(items []Item) {
+	now := time.Now()
+	rp, _ := c.policy.(referencePolicy)
+	for _, item := range items {
+		if item.Value == nil {
+			if rp != nil {
+				rp.SetReferences(item.Key, item.Refs)
+			}
+			continue
+		}
+		if !item.Expire.IsZero() && now.After(item.Expire) {
+			continue
+		}
+		cost := c.cost(item.Key, item.Value)
+		c.clock++
+		if kv, ok := c.cache[item.Key]; ok {
+			c.nbytes += cost - kv.cost
+			kv.value, kv.expire, kv.cost, kv.access = item.Value, item.Expire, cost, c.clock
+			c.policy.Hit(item.Key)
+		} else {
+			c.cache[item.Key] = &entry{key: item.Key, value: item.Value, expire: item.Expire, cost: cost, access: c.clock}
+			c.nbytes += cost
+			c.policy.Add(item.Key)
+		}
+		if rp != nil && item.Refs != nil {
+			rp.SetReferences(item.Key, item.Refs)
+		}
+		c.shrink()
+	}
+}
+
+// Items is like Cache.Items. The order of the entries follows the
+// accesses drained so far, so it is approximate.
+func (c *ConcurrentCache) Items() []Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain()
+	var entries []*entry
+	c.items.Range(func(_, v interface{}) bool {
+		entries = append(entries, v.(*entry))
+		return true
+	})
+	return listItems(c.policy, entries)
+}
+
+// Restore is like Cache.Restore
+func (c *ConcurrentCache) Restore(items []Item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain()
+	now := time.Now()
+	rp, _ := c.policy.(referencePolicy)
+	for _, item := range items {
+		if item.Value == nil {
+			if rp != nil {
+				rp.SetReferences(item.Key, item.Refs)
+			}
+			continue
+		}
+		if !item.Expire.IsZero() && now.After(item.Expire) {
+			continue
+		}
+		cost := c.cost(item.Key, item.Value)
+		c.clock++
+		kv := &entry{key: item.Key, value: item.Value, expire: item.Expire, cost: cost, access: c.clock}
+		if v, ok := c.items.Load(item.Key); ok {
+			c.items.Store(item.Key, kv)
+			atomic.AddInt64(&c.nbytes, cost-v.(*entry).cost)
+			c.policy.Hit(item.Key)
+		} else {
+			c.items.Store(item.Key, kv)
+			atomic.AddInt64(&c.nitems, 1)
+			atomic.AddInt64(&c.nbytes, cost)
+			c.policy.Add(item.Key)
+		}
+		if rp != nil && item.Refs != nil {
+			rp.SetReferences(item.Key, item.Refs)
+		}
+		c.shrink()
+	}
+}
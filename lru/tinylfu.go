@@ -0,0 +1,108 @@
+package lru
+
+// TinyLFU is the W-TinyLFU policy (Einziger, Friedman and Manes). New
+// keys enter a small LRU window. A key pushed out of the window becomes
+// a candidate for the main area, a segmented LRU, and is only let in if
+// a count-min sketch says it is seen more often than the key the main
+// area would evict. Keys hit again in the probation segment of the main
+// area move to its protected segment.
+//
+// The cache is bounded by bytes, so the segment sizes are taken as
+// fractions of the number of keys currently cached.
+type TinyLFU struct {
+	sketch     *cmSketch
+	window     *lruList
+	probation  *lruList
+	protected  *lruList
+	windowPct  float64 // share of cached keys in the window
+	protectPct float64 // share of the main area that is protected
+}
+
+// NewTinyLFU creates a W-TinyLFU policy whose sketch is sized for about
+// n distinct keys
+func NewTinyLFU(n int) *TinyLFU {
+	return &TinyLFU{
+		sketch:     newCMSketch(n),
+		window:     newLRUList(),
+		probation:  newLRUList(),
+		protected:  newLRUList(),
+		windowPct:  0.01,
+		protectPct: 0.8,
+	}
+}
+
+func (p *TinyLFU) size() int {
+	return p.window.len() + p.probation.len() + p.protected.len()
+}
+
+// Admit always lets a key into the window, admission to the main area
+// happens in Victim
+func (p *TinyLFU) Admit(key string) bool { return true }
+
+func (p *TinyLFU) Add(key string) {
+	p.sketch.increment(key)
+	p.window.pushFront(key)
+}
+
+func (p *TinyLFU) Hit(key string) {
+	p.sketch.increment(key)
+	switch {
+	case p.window.moveToFront(key):
+	case p.probation.remove(key):
+		p.protected.pushFront(key)
+		// keep protected within its share, demoting back to probation
+		maxProtected := maxInt(int(float64(p.size()-p.window.len())*p.protectPct), 1)
+		for p.protected.len() > maxProtected {
+			demoted, _ := p.protected.popBack()
+			p.probation.pushFront(demoted)
+		}
+	default:
+		p.protected.moveToFront(key)
+	}
+}
+
+// Miss counts the lookup, so keys asked for often are admitted once loaded
+func (p *TinyLFU) Miss(key string) {
+	p.sketch.increment(key)
+}
+
+func (p *TinyLFU) Victim() (string, bool) {
+	maxWindow := maxInt(int(float64(p.size())*p.windowPct), 1)
+	// keys that entered while the cache still had room were admitted
+	// already, they join the main area without a contest
+	for p.window.len() > maxWindow+1 {
+		key, _ := p.window.popBack()
+		p.probation.pushFront(key)
+	}
+	if p.window.len() > maxWindow {
+		// the window's LRU key competes with the main area's victim,
+		// on a tie the more recent candidate wins
+		candidate, _ := p.window.popBack()
+		victim, ok := p.mainVictim()
+		p.probation.pushFront(candidate)
+		if !ok || p.sketch.estimate(candidate) < p.sketch.estimate(victim) {
+			return candidate, true
+		}
+		return victim, true
+	}
+	if victim, ok := p.mainVictim(); ok {
+		return victim, true
+	}
+	return p.window.back()
+}
+
+// mainVictim is the key the main area would evict
+func (p *TinyLFU) mainVictim() (string, bool) {
+	if key, ok := p.probation.back(); ok {
+		return key, true
+	}
+	return p.protected.back()
+}
+
+func (p *TinyLFU) Remove(key string, reason EvictReason) {
+	if !p.window.remove(key) && !p.probation.remove(key) {
+		p.protected.remove(key)
+	}
+}
+
+var _ EvictionPolicy = (*TinyLFU)(nil)
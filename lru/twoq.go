@@ -0,0 +1,75 @@
+package lru
+
+// TwoQueue is the full 2Q policy (Johnson and Shasha). New keys wait in
+// the FIFO a1in, keys evicted from it are remembered in the ghost FIFO
+// a1out, and only a key seen again while in a1out enters the LRU am.
+// One-off scans therefore never push hot keys out of am.
+//
+// The cache is bounded by bytes, so the queue sizes are taken as
+// fractions of the number of keys currently cached.
+type TwoQueue struct {
+	a1in  *lruList // FIFO of keys seen once, cached
+	a1out *lruList // FIFO of keys evicted from a1in, not cached
+	am    *lruList // LRU of keys seen again, cached
+}
+
+const (
+	twoQueueInRatio  = 0.25 // share of cached keys a1in may hold
+	twoQueueOutRatio = 0.5  // ghosts kept in a1out per cached key
+)
+
+// NewTwoQueue creates a 2Q policy
+func NewTwoQueue() *TwoQueue {
+	return &TwoQueue{
+		a1in:  newLRUList(),
+		a1out: newLRUList(),
+		am:    newLRUList(),
+	}
+}
+
+func (p *TwoQueue) size() int {
+	return p.a1in.len() + p.am.len()
+}
+
+func (p *TwoQueue) Admit(key string) bool { return true }
+
+func (p *TwoQueue) Add(key string) {
+	if p.a1out.remove(key) {
+		p.am.pushFront(key)
+		return
+	}
+	p.a1in.pushFront(key)
+}
+
+// Hit only reorders am, a1in is a FIFO
+func (p *TwoQueue) Hit(key string) {
+	p.am.moveToFront(key)
+}
+
+func (p *TwoQueue) Miss(key string) {}
+
+func (p *TwoQueue) Victim() (string, bool) {
+	kin := maxInt(int(float64(p.size())*twoQueueInRatio), 1)
+	if p.a1in.len() > kin || p.am.len() == 0 {
+		return p.a1in.back()
+	}
+	return p.am.back()
+}
+
+func (p *TwoQueue) Remove(key string, reason EvictReason) {
+	if p.a1in.remove(key) {
+		if reason == EvictCapacity {
+			p.a1out.pushFront(key)
+			kout := maxInt(int(float64(p.size())*twoQueueOutRatio), 1)
+			for p.a1out.len() > kout {
+				p.a1out.popBack()
+			}
+		}
+		return
+	}
+	if !p.am.remove(key) && reason != EvictCapacity {
+		p.a1out.remove(key)
+	}
+}
+
+var _ EvictionPolicy = (*TwoQueue)(nil)
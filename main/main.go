@@ -6,6 +6,13 @@ import (
 	"log"
 	"net/http"
 	"ocache"
+	"ocache/discovery"
+	"ocache/gossip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var db = map[string]string{
@@ -26,12 +33,26 @@ func createGroup() *ocache.Group {
 }
 
 // startCacheServer 启动缓存服务器：创建 HTTPPool, 添加节点信息，注册到o中，启动HTTP服务
-func startCacheServer(addr string, addrs []string, o *ocache.Group) {
+// addr is the base URL peers know this node by, it listens on listen.
+// With gossipAddr the peers are the members of the gossip group joined
+// through seeds, with d they are the ones d finds, instead of addrs.
+func startCacheServer(addr, listen string, addrs []string, gossipAddr string, seeds []string, d discovery.Discovery, o *ocache.Group) {
 	peers := ocache.NewHTTPPool(addr)
-	peers.Set(addrs...)
+	if gossipAddr != "" {
+		if _, err := peers.StartGossip(gossip.Config{BindAddr: gossipAddr, Seeds: seeds}); err != nil {
+			log.Fatal(err)
+		}
+	} else if d != nil {
+		if err := peers.Discover(d); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		peers.Set(addrs...)
+	}
+	peers.StartHealthChecks(time.Second)
 	o.RegisterPeers(peers)
 	log.Println("ocache is running at", addr)
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	log.Fatal(http.ListenAndServe(listen, peers))
 }
 
 // startAPIServer 用来启动一个API服务，与用户进行交互，用户感知
@@ -39,7 +60,7 @@ func startAPIServer(apiAddr string, o *ocache.Group) {
 	http.Handle("/api", http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			key := r.URL.Query().Get("key")
-			view, err := o.Get(key)
+			view, err := o.GetContext(r.Context(), key)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -47,15 +68,72 @@ func startAPIServer(apiAddr string, o *ocache.Group) {
 			w.Header().Set("Content-Type", "application/octet-stream")
 			w.Write(view.ByteSlice())
 		}))
+	http.Handle("/metrics", ocache.MetricsHandler())
 	log.Println("fonted server is running at", apiAddr)
 	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
 }
 
+// loadSnapshot warms o up from the snapshot at path, if there is one
+func loadSnapshot(path string, o *ocache.Group) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Println("[oCache] failed to open snapshot", err)
+		return
+	}
+	defer f.Close()
+	if err := o.Restore(f); err != nil {
+		log.Println("[oCache] failed to restore snapshot", err)
+		return
+	}
+	log.Println("[oCache] restored snapshot", path)
+}
+
+// saveSnapshotOnSignal writes a snapshot of o to path on SIGTERM or
+// SIGINT, then exits. It is written next to path and renamed, so a
+// failed write keeps the previous snapshot.
+func saveSnapshotOnSignal(path string, o *ocache.Group) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sig
+		tmp := path + ".tmp"
+		f, err := os.Create(tmp)
+		if err == nil {
+			err = o.Snapshot(f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			log.Println("[oCache] failed to save snapshot", err)
+			os.Remove(tmp)
+			os.Exit(1)
+		}
+		log.Println("[oCache] saved snapshot", path)
+		os.Exit(0)
+	}()
+}
+
 func main() {
 	var port int
 	var api bool
+	var snapshot string
+	var gossipAddr, seeds string
+	var peersFile, dnsName, self string
 	flag.IntVar(&port, "port", 8001, "oCache server port")
 	flag.BoolVar(&api, "api", false, "Start a api server?")
+	flag.StringVar(&snapshot, "snapshot", "", "Restore the cache from this file on startup and save it there on SIGTERM")
+	flag.StringVar(&gossipAddr, "gossip", "", "UDP address to gossip membership on, e.g. localhost:7001")
+	flag.StringVar(&seeds, "seeds", "", "Comma separated gossip addresses of peers to join through")
+	flag.StringVar(&peersFile, "peers", "", "File listing the peers, reloaded when it changes")
+	flag.StringVar(&dnsName, "dns", "", "Domain whose _ocache._tcp SRV records list the peers")
+	flag.StringVar(&self, "self", "", "Base URL of this node as the discovered peers list it, e.g. http://node1.example.com:8001")
 	flag.Parse()
 
 	apiAddr := "http://localhost:9999"
@@ -65,14 +143,40 @@ func main() {
 		8003: "http://localhost:8003",
 	}
 
+	var addr, listen string
+	if self != "" {
+		addr, listen = self, fmt.Sprintf(":%d", port)
+	} else if a, ok := addrMap[port]; ok {
+		addr, listen = a, a[7:]
+	} else {
+		log.Fatalf("no address for port %d, use -self or one of the ports 8001-8003", port)
+	}
+
+	var d discovery.Discovery
+	if peersFile != "" {
+		d = discovery.NewFile(peersFile)
+	} else if dnsName != "" {
+		d = discovery.NewDNSSRV("ocache", "tcp", dnsName)
+	}
+	var seedList []string
+	if seeds != "" {
+		seedList = strings.Split(seeds, ",")
+	}
+	// the fixed peers are only used when no discovery is asked for
 	var addrs []string
-	for _, v := range addrMap {
-		addrs = append(addrs, v)
+	if d == nil && gossipAddr == "" {
+		for _, v := range addrMap {
+			addrs = append(addrs, v)
+		}
 	}
 
 	o := createGroup()
+	if snapshot != "" {
+		loadSnapshot(snapshot, o)
+		saveSnapshotOnSignal(snapshot, o)
+	}
 	if api {
 		go startAPIServer(apiAddr, o)
 	}
-	startCacheServer(addrMap[port], []string(addrs), o)
+	startCacheServer(addr, listen, addrs, gossipAddr, seedList, d, o)
 }
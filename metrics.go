@@ -0,0 +1,198 @@
+package ocache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsContentType is the media type of the OpenMetrics text format
+const metricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // buckets[i] counts observations <= bounds[i], not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+// observe records v, in seconds
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the first bound >= v, len(bounds) means only +Inf matches
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// since records the time elapsed from start, handy with defer
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+// snapshot returns cumulative bucket counts together with count and sum
+func (h *histogram) snapshot() (cumulative []uint64, count uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative = make([]uint64, len(h.buckets))
+	var acc uint64
+	for i, n := range h.buckets {
+		acc += n
+		cumulative[i] = acc
+	}
+	return cumulative, h.count, h.sum
+}
+
+// groupLatency holds the latency histograms of a Group
+type groupLatency struct {
+	get   *histogram // Group.Get
+	peer  *histogram // Group.getFromPeer
+	local *histogram // Group.getLocally
+}
+
+func newGroupLatency() groupLatency {
+	return groupLatency{
+		get:   newHistogram(latencyBuckets),
+		peer:  newHistogram(latencyBuckets),
+		local: newHistogram(latencyBuckets),
+	}
+}
+
+// MetricsHandler returns a handler that exposes the counters, latency
+// histograms and cache gauges of every group in the OpenMetrics text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gs := getGroups()
+		names := make([]string, 0, len(gs))
+		for name := range gs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]*Group, 0, len(names))
+		for _, name := range names {
+			list = append(list, gs[name])
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		writeMetrics(w, list)
+	})
+}
+
+// writeMetrics writes metric families for groups, in the given order
+func writeMetrics(w io.Writer, groups []*Group) error {
+	bw := bufio.NewWriter(w)
+
+	counters := []struct {
+		name, help string
+		value      func(s *Stats) *AtomicInt
+	}{
+		{"ocache_gets", "Get requests, including from peers.", func(s *Stats) *AtomicInt { return &s.Gets }},
+		{"ocache_cache_hits", "Get requests served by mainCache or hotCache.", func(s *Stats) *AtomicInt { return &s.CacheHits }},
+		{"ocache_peer_loads", "Values loaded from a peer.", func(s *Stats) *AtomicInt { return &s.PeerLoads }},
+		{"ocache_peer_errors", "Failed loads from a peer.", func(s *Stats) *AtomicInt { return &s.PeerErrors }},
+		{"ocache_local_loads", "Values loaded by the Getter.", func(s *Stats) *AtomicInt { return &s.LocalLoads }},
+		{"ocache_local_load_errors", "Failed loads by the Getter.", func(s *Stats) *AtomicInt { return &s.LocalLoadErrs }},
+		{"ocache_loads_deduped", "Loads that waited on an in-flight load of the same key.", func(s *Stats) *AtomicInt { return &s.LoadsDeduped }},
+		{"ocache_negative_hits", "Get requests answered by a remembered not found.", func(s *Stats) *AtomicInt { return &s.NegativeHits }},
+		{"ocache_bloom_rejects", "Get requests rejected by the Bloom filter.", func(s *Stats) *AtomicInt { return &s.BloomRejects }},
+		{"ocache_disk_hits", "Loads served by the disk cache.", func(s *Stats) *AtomicInt { return &s.DiskHits }},
+		{"ocache_server_requests", "Get requests that came over the network from peers.", func(s *Stats) *AtomicInt { return &s.ServerRequests }},
+	}
+	for _, c := range counters {
+		writeHeader(bw, c.name, "counter", c.help)
+		for _, g := range groups {
+			fmt.Fprintf(bw, "%s_total{group=\"%s\"} %d\n", c.name, escapeLabel(g.name), c.value(&g.Stats).Get())
+		}
+	}
+
+	histograms := []struct {
+		name, help string
+		h          func(g *Group) *histogram
+	}{
+		{"ocache_get_duration_seconds", "Latency of Group.Get.", func(g *Group) *histogram { return g.latency.get }},
+		{"ocache_peer_load_duration_seconds", "Latency of loading a value from a peer.", func(g *Group) *histogram { return g.latency.peer }},
+		{"ocache_local_load_duration_seconds", "Latency of loading a value with the Getter.", func(g *Group) *histogram { return g.latency.local }},
+	}
+	for _, hf := range histograms {
+		writeHeader(bw, hf.name, "histogram", hf.help)
+		for _, g := range groups {
+			h := hf.h(g)
+			cumulative, count, sum := h.snapshot()
+			group := escapeLabel(g.name)
+			for i, bound := range h.bounds {
+				fmt.Fprintf(bw, "%s_bucket{group=\"%s\",le=\"%s\"} %d\n", hf.name, group, formatBound(bound), cumulative[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket{group=\"%s\",le=\"+Inf\"} %d\n", hf.name, group, count)
+			fmt.Fprintf(bw, "%s_sum{group=\"%s\"} %s\n", hf.name, group, formatFloat(sum))
+			fmt.Fprintf(bw, "%s_count{group=\"%s\"} %d\n", hf.name, group, count)
+		}
+	}
+
+	gauges := []struct {
+		name, help string
+		value      func(s CacheStats) int64
+	}{
+		{"ocache_cache_bytes", "Bytes taken by keys and values in the cache, including the LRU-K history.", func(s CacheStats) int64 { return s.Bytes }},
+		{"ocache_cache_history_bytes", "Bytes taken by the LRU-K history.", func(s CacheStats) int64 { return s.HistoryBytes }},
+		{"ocache_cache_max_bytes", "Byte limit of the cache, 0 means unlimited.", func(s CacheStats) int64 { return s.MaxBytes }},
+		{"ocache_cache_items", "Entries in the cache.", func(s CacheStats) int64 { return s.Items }},
+	}
+	stats := make([][2]CacheStats, len(groups))
+	for i, g := range groups {
+		stats[i] = [2]CacheStats{g.CacheStats(MainCache), g.CacheStats(HotCache)}
+	}
+	for _, gf := range gauges {
+		writeHeader(bw, gf.name, "gauge", gf.help)
+		for i, g := range groups {
+			group := escapeLabel(g.name)
+			fmt.Fprintf(bw, "%s{group=\"%s\",cache=\"main\"} %d\n", gf.name, group, gf.value(stats[i][0]))
+			fmt.Fprintf(bw, "%s{group=\"%s\",cache=\"hot\"} %d\n", gf.name, group, gf.value(stats[i][1]))
+		}
+	}
+
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", name, typ, name, help)
+}
+
+// escapeLabel escapes a label value as required by the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatBound formats a bucket bound in the canonical form OpenMetrics
+// asks of le, e.g. "1.0" rather than "1"
+func formatBound(v float64) string {
+	s := formatFloat(v)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,156 @@
+package ocache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	g := NewGroup("metrics", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	g.Stats.Gets.Add(3)
+	g.Stats.CacheHits.Add(2)
+	g.Stats.LocalLoads.Add(1)
+	g.latency.get.observe(0.0002)
+	g.latency.get.observe(0.002)
+	g.latency.get.observe(10)
+	g.latency.local.observe(0.002)
+	g.mainCache.add("Tom", ByteView{b: []byte("630")})
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, []*Group{g}); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# TYPE ocache_gets counter
+# HELP ocache_gets Get requests, including from peers.
+ocache_gets_total{group="metrics"} 3
+# TYPE ocache_cache_hits counter
+# HELP ocache_cache_hits Get requests served by mainCache or hotCache.
+ocache_cache_hits_total{group="metrics"} 2
+# TYPE ocache_peer_loads counter
+# HELP ocache_peer_loads Values loaded from a peer.
+ocache_peer_loads_total{group="metrics"} 0
+# TYPE ocache_peer_errors counter
+# HELP ocache_peer_errors Failed loads from a peer.
+ocache_peer_errors_total{group="metrics"} 0
+# TYPE ocache_local_loads counter
+# HELP ocache_local_loads Values loaded by the Getter.
+ocache_local_loads_total{group="metrics"} 1
+# TYPE ocache_local_load_errors counter
+# HELP ocache_local_load_errors Failed loads by the Getter.
+ocache_local_load_errors_total{group="metrics"} 0
+# TYPE ocache_loads_deduped counter
+# HELP ocache_loads_deduped Loads that waited on an in-flight load of the same key.
+ocache_loads_deduped_total{group="metrics"} 0
+# TYPE ocache_negative_hits counter
+# HELP ocache_negative_hits Get requests answered by a remembered not found.
+ocache_negative_hits_total{group="metrics"} 0
+# TYPE ocache_bloom_rejects counter
+# HELP ocache_bloom_rejects Get requests rejected by the Bloom filter.
+ocache_bloom_rejects_total{group="metrics"} 0
+# TYPE ocache_disk_hits counter
+# HELP ocache_disk_hits Loads served by the disk cache.
+ocache_disk_hits_total{group="metrics"} 0
+# TYPE ocache_server_requests counter
+# HELP ocache_server_requests Get requests that came over the network from peers.
+ocache_server_requests_total{group="metrics"} 0
+# TYPE ocache_get_duration_seconds histogram
+# HELP ocache_get_duration_seconds Latency of Group.Get.
+ocache_get_duration_seconds_bucket{group="metrics",le="0.0001"} 0
+ocache_get_duration_seconds_bucket{group="metrics",le="0.0005"} 1
+ocache_get_duration_seconds_bucket{group="metrics",le="0.001"} 1
+ocache_get_duration_seconds_bucket{group="metrics",le="0.005"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="0.01"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="0.05"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="0.1"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="0.5"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="1.0"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="5.0"} 2
+ocache_get_duration_seconds_bucket{group="metrics",le="+Inf"} 3
+ocache_get_duration_seconds_sum{group="metrics"} 10.0022
+ocache_get_duration_seconds_count{group="metrics"} 3
+# TYPE ocache_peer_load_duration_seconds histogram
+# HELP ocache_peer_load_duration_seconds Latency of loading a value from a peer.
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.0001"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.0005"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.001"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.005"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.01"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.05"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.1"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="0.5"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="1.0"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="5.0"} 0
+ocache_peer_load_duration_seconds_bucket{group="metrics",le="+Inf"} 0
+ocache_peer_load_duration_seconds_sum{group="metrics"} 0
+ocache_peer_load_duration_seconds_count{group="metrics"} 0
+# TYPE ocache_local_load_duration_seconds histogram
+# HELP ocache_local_load_duration_seconds Latency of loading a value with the Getter.
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.0001"} 0
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.0005"} 0
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.001"} 0
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.005"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.01"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.05"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.1"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="0.5"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="1.0"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="5.0"} 1
+ocache_local_load_duration_seconds_bucket{group="metrics",le="+Inf"} 1
+ocache_local_load_duration_seconds_sum{group="metrics"} 0.002
+ocache_local_load_duration_seconds_count{group="metrics"} 1
+# TYPE ocache_cache_bytes gauge
+# HELP ocache_cache_bytes Bytes taken by keys and values in the cache, including the LRU-K history.
+ocache_cache_bytes{group="metrics",cache="main"} 246
+ocache_cache_bytes{group="metrics",cache="hot"} 0
+# TYPE ocache_cache_history_bytes gauge
+# HELP ocache_cache_history_bytes Bytes taken by the LRU-K history.
+ocache_cache_history_bytes{group="metrics",cache="main"} 0
+ocache_cache_history_bytes{group="metrics",cache="hot"} 0
+# TYPE ocache_cache_max_bytes gauge
+# HELP ocache_cache_max_bytes Byte limit of the cache, 0 means unlimited.
+ocache_cache_max_bytes{group="metrics",cache="main"} 2048
+ocache_cache_max_bytes{group="metrics",cache="hot"} 960
+# TYPE ocache_cache_items gauge
+# HELP ocache_cache_items Entries in the cache.
+ocache_cache_items{group="metrics",cache="main"} 1
+ocache_cache_items{group="metrics",cache="hot"} 0
+# EOF
+`
+	if got := buf.String(); got != expect {
+		t.Fatalf("unexpected exposition:\n%s\nexpect:\n%s", got, expect)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	NewGroup("metrics\"quoted", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `ocache_gets_total{group="metrics\"quoted"} 0`+"\n") {
+		t.Fatalf("group label not escaped:\n%s", body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatalf("exposition must end with # EOF")
+	}
+}
+
+func TestFormatBound(t *testing.T) {
+	for bound, want := range map[float64]string{0: "0.0", 1: "1.0", 10: "10.0", 0.25: "0.25", 1e-05: "1e-05"} {
+		if got := formatBound(bound); got != want {
+			t.Errorf("formatBound(%v) = %q, want %q", bound, got, want)
+		}
+	}
+}
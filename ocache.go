@@ -1,11 +1,19 @@
 package ocache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"ocache/disk"
+	"ocache/lru"
 	pb "ocache/ocachepb"
 	"ocache/singleflight"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // A Getter loads data for a key
@@ -24,6 +32,66 @@ func (f GetterFunc) Get(key string) ([]byte, error) {
 	return f(key)
 }
 
+// A TTLGetter loads data for a key together with how long it stays fresh.
+// A zero ttl falls back to the Group's default TTL.
+type TTLGetter interface {
+	GetWithTTL(key string) ([]byte, time.Duration, error)
+}
+
+// A TTLGetterFunc implements both Getter and TTLGetter with a function.
+type TTLGetterFunc func(key string) ([]byte, time.Duration, error)
+
+// GetWithTTL implements TTLGetter interface function
+func (f TTLGetterFunc) GetWithTTL(key string) ([]byte, time.Duration, error) {
+	return f(key)
+}
+
+// Get implements Getter interface function, dropping the ttl
+func (f TTLGetterFunc) Get(key string) ([]byte, error) {
+	b, _, err := f(key)
+	return b, err
+}
+
+// A ContextGetter is the context-aware form of TTLGetter. ctx carries the
+// deadline and values of the request that caused the load, and the load
+// should give up once ctx is done.
+type ContextGetter interface {
+	GetContext(ctx context.Context, key string) ([]byte, time.Duration, error)
+}
+
+// A ContextGetterFunc implements Getter, TTLGetter and ContextGetter with a function.
+type ContextGetterFunc func(ctx context.Context, key string) ([]byte, time.Duration, error)
+
+// GetContext implements ContextGetter interface function
+func (f ContextGetterFunc) GetContext(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return f(ctx, key)
+}
+
+// GetWithTTL implements TTLGetter interface function with a background context
+func (f ContextGetterFunc) GetWithTTL(key string) ([]byte, time.Duration, error) {
+	return f(context.Background(), key)
+}
+
+// Get implements Getter interface function with a background context
+func (f ContextGetterFunc) Get(key string) ([]byte, error) {
+	b, _, err := f(context.Background(), key)
+	return b, err
+}
+
+// ErrNotFound should be returned, possibly wrapped with %w, by a Getter
+// when the key does not exist in the data source. Such failures can be
+// remembered for a while with WithNegativeTTL, see 缓存穿透 in the readme.
+var ErrNotFound = errors.New("not found")
+
+const (
+	defaultHotRatio      = 8
+	defaultHotOneIn      = 10
+	defaultNegativeRatio = 16
+	// minSubCacheEntries is how many empty entries hotCache and negCache
+	// have room for at least
+	minSubCacheEntries = 4
+)
+
 var (
 	mu     sync.RWMutex
 	groups = make(map[string]*Group)
@@ -34,14 +102,220 @@ type Group struct {
 	name      string // namespace
 	getter    Getter // 缓存未命中时获取源数据的回调(callback)
 	mainCache cache  //并发缓存
-	peers     PeerPicker
+	// hotCache holds values owned by other peers that are fetched often
+	// enough to be worth mirroring locally, saving a network round trip.
+	hotCache cache
+	// hotOneIn is the chance (1/hotOneIn) a peer value enters hotCache,
+	// 0 disables hotCache
+	hotOneIn int
+	// negCache remembers keys the Getter reported as ErrNotFound for negTTL,
+	// 0 disables negative caching
+	negCache cache
+	negTTL   time.Duration
+	// bloom rejects keys that are not in the data source, nil if disabled
+	bloom *bloomGuard
+	// l2 keeps values evicted from mainCache on local disk, nil if disabled
+	l2      *disk.Cache
+	demoter *demoter // writes to l2 in the background
+	peers   PeerPicker
 	// use singleflight.Group to make sure that
 	// each key is only fetched once
 	loader *singleflight.Group
+	// ttl is the lifetime of locally loaded values, 0 means never expire
+	ttl time.Duration
+	// sweepInterval is how often expired entries are purged in background
+	sweepInterval time.Duration
+	// done is closed by Close to stop the background goroutines
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// Stats are statistics on the group.
+	Stats Stats
+	// latency holds histograms exported by MetricsHandler
+	latency groupLatency
+}
+
+// Stats are per-group statistics.
+type Stats struct {
+	Gets           AtomicInt `json:"gets"`            // any Get request, including from peers
+	CacheHits      AtomicInt `json:"cache_hits"`      // either cache was good
+	PeerLoads      AtomicInt `json:"peer_loads"`      // either remote load or remote cache hit (not an error)
+	PeerErrors     AtomicInt `json:"peer_errors"`     // failed to get from a peer
+	LocalLoads     AtomicInt `json:"local_loads"`     // total good local loads
+	LocalLoadErrs  AtomicInt `json:"local_load_errs"` // total bad local loads
+	LoadsDeduped   AtomicInt `json:"loads_deduped"`   // loads that waited on an in-flight singleflight call
+	NegativeHits   AtomicInt `json:"negative_hits"`   // gets answered by a remembered ErrNotFound
+	BloomRejects   AtomicInt `json:"bloom_rejects"`   // gets rejected by the Bloom filter
+	DiskHits       AtomicInt `json:"disk_hits"`       // loads served by the disk cache
+	ServerRequests AtomicInt `json:"server_requests"` // gets that came over the network from peers
+}
+
+// An AtomicInt is an int64 to be accessed atomically.
+type AtomicInt int64
+
+// Add atomically adds n to i.
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get atomically gets the value of i.
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *AtomicInt) String() string {
+	return strconv.FormatInt(i.Get(), 10)
+}
+
+// MarshalJSON encodes the value read atomically
+func (i *AtomicInt) MarshalJSON() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// A GroupOption configures optional behaviour of a Group.
+type GroupOption func(*Group)
+
+// WithTTL sets the default lifetime of values loaded by the Getter.
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.ttl = ttl
+	}
+}
+
+// WithSweepInterval starts a background sweeper that purges expired
+// entries every interval, until Close is called. Without it expired
+// entries are only dropped lazily on Get or by capacity eviction.
+func WithSweepInterval(interval time.Duration) GroupOption {
+	return func(g *Group) {
+		g.sweepInterval = interval
+	}
+}
+
+// WithEvictedFunc registers fn to be called whenever an entry leaves mainCache.
+func WithEvictedFunc(fn func(key string, value ByteView, reason lru.EvictReason)) GroupOption {
+	return func(g *Group) {
+		g.mainCache.onEvicted = fn
+	}
+}
+
+// WithCorrelatedPeriod makes the LRU-K policy of mainCache count
+// references to a key less than period apart as one, so a burst of Gets
+// does not by itself reach K.
+func WithCorrelatedPeriod(period time.Duration) GroupOption {
+	return func(g *Group) {
+		g.mainCache.crp = period
+	}
+}
+
+// WithHistoryBytes bounds the memory of the LRU-K history of mainCache
+// by n bytes, on top of the historyMax key count passed to NewGroup. If
+// shared, the history also counts toward cacheBytes and competes with
+// the cached values for it.
+func WithHistoryBytes(n int64, shared bool) GroupOption {
+	return func(g *Group) {
+		g.mainCache.historyBytes = n
+		g.mainCache.sharedHistory = shared
+	}
+}
+
+// WithHashedHistory keeps 64-bit hashes instead of keys in the LRU-K
+// history of mainCache, so long keys take little memory there. Keys
+// with colliding hashes share their reference counts.
+func WithHashedHistory() GroupOption {
+	return func(g *Group) {
+		g.mainCache.hashHistory = true
+	}
+}
+
+// WithEvictionPolicy replaces the LRU-K policy of mainCache, e.g. with
+// lru.NewARC or lru.NewTinyLFU. k and historyMax passed to NewGroup are
+// then ignored. newPolicy is called once per shard, when the cache is
+// first used.
+func WithEvictionPolicy(newPolicy func() lru.EvictionPolicy) GroupOption {
+	return func(g *Group) {
+		g.mainCache.newPolicy = newPolicy
+	}
+}
+
+// WithShards splits mainCache into n shards chosen by key hash, each
+// with its own lock and an equal part of cacheBytes. More shards let
+// concurrent Gets of different keys proceed in parallel, at the cost of
+// eviction being decided per shard rather than across the whole cache.
+func WithShards(n int) GroupOption {
+	return func(g *Group) {
+		g.mainCache.nshards = n
+	}
+}
+
+// WithLockFreeReads backs mainCache with lru.ConcurrentCache, whose Get
+// takes no lock. Accesses reach the eviction policy in sampled batches,
+// so eviction follows recency and frequency only approximately.
+func WithLockFreeReads() GroupOption {
+	return func(g *Group) {
+		g.mainCache.lockFree = true
+	}
+}
+
+// WithSlabStorage keeps the values of mainCache in large byte segments
+// instead of one heap object per entry, so a big cache adds little work
+// for the garbage collector. Entries are then evicted FIFO, a segment at
+// a time, and the eviction policy and WithLockFreeReads do not apply.
+func WithSlabStorage() GroupOption {
+	return func(g *Group) {
+		g.mainCache.slab = true
+	}
+}
+
+// WithCost sets what a value is charged against the cacheBytes of
+// mainCache, hotCache and negCache. By default it is lru.EstimatedCost,
+// the key and value bytes plus an estimate of the per-entry overhead, so
+// cacheBytes approximately bounds the heap taken. lru.KeyValueCost
+// charges only the key and value bytes.
+func WithCost(cost lru.CostFunc) GroupOption {
+	return func(g *Group) {
+		g.mainCache.cost = cost
+		g.hotCache.cost = cost
+		g.negCache.cost = cost
+	}
+}
+
+// WithHotCache sizes hotCache as ratio of cacheBytes and admits a value
+// fetched from a peer with a chance of 1/oneIn. A ratio of 0 disables it.
+// By default hotCache takes 1/8 of cacheBytes and admits 1 in 10 values.
+func WithHotCache(ratio float64, oneIn int) GroupOption {
+	return func(g *Group) {
+		g.hotCache.cacheBytes = int64(float64(g.mainCache.cacheBytes) * ratio)
+		g.hotOneIn = oneIn
+		if ratio <= 0 || oneIn <= 0 {
+			g.hotOneIn = 0
+		}
+	}
+}
+
+// WithNegativeTTL remembers for ttl that a key was not found, either by
+// the Getter returning ErrNotFound or by the owning peer, so repeated
+// lookups of missing keys stop reaching the data source.
+func WithNegativeTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.negTTL = ttl
+	}
+}
+
+// WithDiskCache demotes values evicted from mainCache for lack of room
+// to l2, a cache on local disk. On a miss Get looks in l2 before asking a
+// peer or the Getter, and a value found there is promoted back to
+// mainCache. Evicted values are written to l2 in the background, until
+// Close; if the writes fall behind by more than a thousand values the
+// newer ones are dropped.
+func WithDiskCache(l2 *disk.Cache) GroupOption {
+	return func(g *Group) {
+		g.l2 = l2
+	}
 }
 
 // NewGroup create a new instance of Group
-func NewGroup(name string, cacheBytes int64, k, historyMax int, getter Getter) *Group {
+func NewGroup(name string, cacheBytes int64, k, historyMax int, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
@@ -51,12 +325,78 @@ func NewGroup(name string, cacheBytes int64, k, historyMax int, getter Getter) *
 		name:      name,
 		getter:    getter,
 		mainCache: cache{cacheBytes: cacheBytes, K: k, historyMax: historyMax},
+		hotCache:  cache{cacheBytes: cacheBytes / defaultHotRatio, K: 1},
+		hotOneIn:  defaultHotOneIn,
+		negCache:  cache{cacheBytes: cacheBytes / defaultNegativeRatio, K: 1},
 		loader:    &singleflight.Group{},
+		latency:   newGroupLatency(),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.hotCache.fitEntries(g.mainCache.cacheBytes)
+	g.negCache.fitEntries(g.mainCache.cacheBytes)
+	if g.l2 != nil {
+		g.demoter = newDemoter(g.l2)
+		g.mainCache.onEvicted = g.demote(g.mainCache.onEvicted)
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.demoter.run(g.done)
+		}()
+	}
+	if g.sweepInterval > 0 {
+		g.wg.Add(1)
+		go g.sweep()
+	}
+	if g.bloom != nil && g.bloom.src != nil {
+		g.RebuildBloomFilter(context.Background())
 	}
 	groups[name] = g
 	return g
 }
 
+// Close stops the background goroutines of the group and waits for them
+// to return, after the values waiting to be demoted to l2 are written.
+// The group still serves Gets, expired entries are then only dropped
+// lazily and evicted values are no longer demoted.
+func (g *Group) Close() {
+	g.closeOnce.Do(func() { close(g.done) })
+	g.wg.Wait()
+}
+
+// sweep purges expired entries from mainCache every sweepInterval, until
+// Close
+func (g *Group) sweep() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			g.mainCache.removeExpired(now)
+			g.hotCache.removeExpired(now)
+			g.negCache.removeExpired(now)
+		}
+	}
+}
+
+// demote returns an onEvicted that queues values evicted for capacity to
+// be written to l2, then calls next if it is not nil
+func (g *Group) demote(next func(string, ByteView, lru.EvictReason)) func(string, ByteView, lru.EvictReason) {
+	return func(key string, value ByteView, reason lru.EvictReason) {
+		if reason == lru.EvictCapacity {
+			g.demoter.add(key, value)
+		}
+		if next != nil {
+			next(key, value, reason)
+		}
+	}
+}
+
 // GetGroup returns the named group previously created with NewGroup, or
 // nil if there's no such group.
 func GetGroup(name string) *Group {
@@ -66,20 +406,126 @@ func GetGroup(name string) *Group {
 	return g
 }
 
+// getGroups returns a snapshot of all groups keyed by name
+func getGroups() map[string]*Group {
+	mu.RLock()
+	defer mu.RUnlock()
+	gs := make(map[string]*Group, len(groups))
+	for name, g := range groups {
+		gs[name] = g
+	}
+	return gs
+}
+
 // Get value for a key from cache
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, ctx is passed on to the peer or the Getter
+// that loads the value on a cache miss.
+func (g *Group) GetContext(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
+	g.Stats.Gets.Add(1)
+	defer g.latency.get.since(time.Now())
 
 	// cache hit
 	if v, ok := g.mainCache.get(key); ok {
 		log.Println("[oCache] hit")
+		g.Stats.CacheHits.Add(1)
 		return v, nil
 	}
+	if g.hotOneIn > 0 {
+		if v, ok := g.hotCache.get(key); ok {
+			log.Println("[oCache] hot hit")
+			g.Stats.CacheHits.Add(1)
+			return v, nil
+		}
+	}
+	if g.negTTL > 0 {
+		if _, ok := g.negCache.get(key); ok {
+			g.Stats.NegativeHits.Add(1)
+			return ByteView{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+	}
+	if g.bloom != nil && !g.bloom.allow(key) {
+		g.Stats.BloomRejects.Add(1)
+		return ByteView{}, fmt.Errorf("%s: %w", key, ErrBloomRejected)
+	}
 
 	// cache miss
-	return g.load(key)
+	return g.load(ctx, key)
+}
+
+// GetSink is like GetContext, but hands the value to dest instead of
+// returning it, which saves a copy for sinks that decode the cached bytes
+// directly, such as ProtoSink.
+func (g *Group) GetSink(ctx context.Context, key string, dest Sink) error {
+	if dest == nil {
+		return fmt.Errorf("nil dest Sink")
+	}
+	value, err := g.GetContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	return setSinkView(dest, value)
+}
+
+// Remove drops key from the cache. When peers are registered the
+// invalidation is also forwarded to the peer that owns key, the key is
+// dropped locally even if that fails and the peer's error is returned.
+func (g *Group) Remove(key string) error {
+	return g.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext is like Remove, ctx bounds the call to the owning peer.
+func (g *Group) RemoveContext(ctx context.Context, key string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	var err error
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			err = peerRemove(ctx, peer, &pb.Request{Group: g.name, Key: key})
+		}
+	}
+	g.removeLocally(key)
+	return err
+}
+
+// removeLocally drops key from this node only
+func (g *Group) removeLocally(key string) {
+	g.mainCache.remove(key)
+	g.hotCache.remove(key)
+	g.negCache.remove(key)
+	if g.l2 != nil {
+		g.demoter.remove(key)
+	}
+}
+
+// A CacheType selects one of the caches of a Group.
+type CacheType int
+
+const (
+	// MainCache is the cache for items this peer is the owner of.
+	MainCache CacheType = iota + 1
+	// HotCache is the cache for items that seem popular enough to
+	// replicate to this node, even though it's not the owner.
+	HotCache
+)
+
+// CacheStats returns stats about the provided cache within the group.
+func (g *Group) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return g.mainCache.stats()
+	case HotCache:
+		return g.hotCache.stats()
+	default:
+		return CacheStats{}
+	}
 }
 
 // RegisterPeers 将 实现了 PeerPicker 接口的 HTTPPool 注入到 Group 中。
@@ -90,21 +536,47 @@ func (g *Group) RegisterPeers(peers PeerPicker) {
 	g.peers = peers
 }
 
-func (g *Group) load(key string) (value ByteView, err error) {
+func (g *Group) load(ctx context.Context, key string) (value ByteView, err error) {
 	// each key is only fetched once (either locally or remotely)
 	// regardless of the number of concurrent callers.
+	// Callers that join an in-flight load share the ctx of the first caller.
+	executed := false
 	viewi, err := g.loader.Do(key, func() (interface{}, error) {
+		executed = true
+		if value, ok := g.getFromDisk(key); ok {
+			return value, nil
+		}
 		if g.peers != nil {
 			if peer, ok := g.peers.PickPeer(key); ok {
-				if value, err = g.getFromPeer(peer, key); err == nil {
+				if value, err = g.getFromPeer(ctx, peer, key); err == nil {
+					g.Stats.PeerLoads.Add(1)
 					return value, nil
 				}
+				if errors.Is(err, ErrNotFound) {
+					// the owner has the final say, don't ask the Getter again
+					g.Stats.PeerLoads.Add(1)
+					g.populateNegative(key)
+					return nil, err
+				}
+				g.Stats.PeerErrors.Add(1)
 				log.Println("[GeeCache] Failed to get from peer", err)
 			}
 		}
 
-		return g.getLocally(key)
+		value, err = g.getLocally(ctx, key)
+		if err != nil {
+			g.Stats.LocalLoadErrs.Add(1)
+			if errors.Is(err, ErrNotFound) {
+				g.populateNegative(key)
+			}
+			return nil, err
+		}
+		g.Stats.LocalLoads.Add(1)
+		return value, nil
 	})
+	if !executed {
+		g.Stats.LoadsDeduped.Add(1)
+	}
 
 	if err == nil {
 		return viewi.(ByteView), nil
@@ -113,31 +585,100 @@ func (g *Group) load(key string) (value ByteView, err error) {
 }
 
 // getFromPeer() 使用实现了 PeerGetter 接口的 httpGetter 从访问远程节点，获取缓存值。
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
+	defer g.latency.peer.since(time.Now())
 	req := &pb.Request{
 		Group: g.name,
 		Key:   key,
 	}
 	res := &pb.Response{}
-	err := peer.Get(req, res)
+	err := peerGet(ctx, peer, req, res)
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{b: res.Value}, nil
+	if res.NotFound {
+		return ByteView{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	value := viewFromResponse(res)
+	// mirror a sample of remote values so popular keys stop paying a round trip
+	if g.hotOneIn > 0 && rand.Intn(g.hotOneIn) == 0 {
+		g.hotCache.add(key, value)
+	}
+	return value, nil
+}
 
+// getFromDisk looks key up in l2 and promotes it back to mainCache
+func (g *Group) getFromDisk(key string) (ByteView, bool) {
+	if g.l2 == nil {
+		return ByteView{}, false
+	}
+	value, ok := g.demoter.get(key)
+	if !ok {
+		b, e, found := g.l2.Get(key)
+		if !found {
+			return ByteView{}, false
+		}
+		value = ByteView{b: b, e: e}
+	}
+	g.Stats.DiskHits.Add(1)
+	g.populateCache(key, value)
+	return value, true
 }
 
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key) // get from source data
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	defer g.latency.local.since(time.Now())
+	value, err := g.getFromGetter(ctx, key)
 	if err != nil {
 		return ByteView{}, err
 	}
-	value := ByteView{b: cloneBytes(bytes)}
+	if value.e.IsZero() && g.ttl > 0 {
+		value.e = time.Now().Add(g.ttl)
+	}
 	// add source data to main cache
 	g.populateCache(key, value)
 	return value, nil
 }
 
+// getFromGetter calls the most capable interface g.getter implements
+func (g *Group) getFromGetter(ctx context.Context, key string) (ByteView, error) {
+	if sg, ok := g.getter.(SinkGetter); ok {
+		var value ByteView
+		if err := sg.GetSink(ctx, key, ByteViewSink(&value)); err != nil {
+			return ByteView{}, err
+		}
+		return value, nil
+	}
+
+	var (
+		bytes []byte
+		ttl   time.Duration
+		err   error
+	)
+	if cg, ok := g.getter.(ContextGetter); ok {
+		bytes, ttl, err = cg.GetContext(ctx, key)
+	} else if tg, ok := g.getter.(TTLGetter); ok {
+		bytes, ttl, err = tg.GetWithTTL(key)
+	} else {
+		bytes, err = g.getter.Get(key)
+	}
+	if err != nil {
+		return ByteView{}, err
+	}
+	value := ByteView{b: cloneBytes(bytes)}
+	if ttl > 0 {
+		value.e = time.Now().Add(ttl)
+	}
+	return value, nil
+}
+
 func (g *Group) populateCache(key string, value ByteView) {
 	g.mainCache.add(key, value)
 }
+
+// populateNegative remembers that key does not exist for negTTL
+func (g *Group) populateNegative(key string) {
+	if g.negTTL <= 0 {
+		return
+	}
+	g.negCache.add(key, ByteView{e: time.Now().Add(g.negTTL)})
+}
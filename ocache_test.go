@@ -1,9 +1,24 @@
 package ocache
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"ocache/disk"
+	"ocache/lru"
+	pb "ocache/ocachepb"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 )
 
 var db = map[string]string{
@@ -49,3 +64,716 @@ func TestGet(t *testing.T) {
 		t.Fatalf("the value of unknow should be empty, but %s got", view)
 	}
 }
+
+func TestGetWithTTL(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		loads    int
+		expired  int
+		getterFn = TTLGetterFunc(func(key string) ([]byte, time.Duration, error) {
+			loads++
+			if key == "short" {
+				return []byte("v"), 10 * time.Millisecond, nil
+			}
+			return []byte("v"), 0, nil
+		})
+		onEvicted = func(key string, value ByteView, reason lru.EvictReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			if reason == lru.EvictExpired {
+				expired++
+			}
+		}
+	)
+	g := NewGroup("ttl", 2<<10, 1, 30, getterFn,
+		WithTTL(time.Hour), WithSweepInterval(5*time.Millisecond), WithEvictedFunc(onEvicted))
+	defer g.Close()
+
+	for _, key := range []string{"short", "long"} {
+		if _, err := g.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := g.Get("long"); v.Expire().IsZero() || time.Until(v.Expire()) < 59*time.Minute {
+		t.Fatalf("default ttl not applied, expire %v", v.Expire())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if expired != 1 {
+		t.Fatalf("sweeper expired %d entries, expect 1", expired)
+	}
+	mu.Unlock()
+
+	if _, err := g.Get("short"); err != nil || loads != 3 {
+		t.Fatalf("expired key should be reloaded, loads = %d", loads)
+	}
+	if _, err := g.Get("long"); err != nil || loads != 3 {
+		t.Fatalf("fresh key should hit, loads = %d", loads)
+	}
+
+	// once closed the sweeper leaves the reloaded short key alone
+	g.Close()
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if expired != 1 {
+		t.Fatalf("sweeper expired %d entries after Close, expect 1", expired)
+	}
+	mu.Unlock()
+}
+
+func TestCorrelatedPeriod(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  []GroupOption
+		loads int
+	}{
+		// the second Get is the second reference, the third one hits
+		{"every reference counts", nil, 2},
+		// back to back Gets are one reference, Tom is never cached
+		{"one hour period", []GroupOption{WithCorrelatedPeriod(time.Hour)}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loads := 0
+			g := NewGroup("crp", 2<<10, 2, 30, GetterFunc(func(key string) ([]byte, error) {
+				loads++
+				return []byte(db[key]), nil
+			}), tc.opts...)
+			for i := 0; i < 3; i++ {
+				if v, err := g.Get("Tom"); err != nil || v.String() != db["Tom"] {
+					t.Fatalf("failed to get value of Tom")
+				}
+			}
+			if loads != tc.loads {
+				t.Fatalf("loaded %d times, expect %d", loads, tc.loads)
+			}
+		})
+	}
+}
+
+func TestHistoryBytes(t *testing.T) {
+	const budget = 2 << 10
+	g := NewGroup("history", 8<<10, 2, 0, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithHistoryBytes(budget, false), WithHashedHistory())
+
+	for i := 0; i < 100; i++ {
+		if _, err := g.Get(fmt.Sprintf("%0200d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := g.CacheStats(MainCache)
+	if s.HistoryBytes == 0 || s.HistoryBytes > budget || s.Items != 0 {
+		t.Fatalf("unexpected main cache stats %+v", s)
+	}
+	if s.Bytes != s.HistoryBytes {
+		t.Fatalf("Bytes %d should include the history bytes %d", s.Bytes, s.HistoryBytes)
+	}
+}
+
+func TestCost(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  []GroupOption
+		bytes int64
+	}{
+		{"estimated by default", nil, int64(len("Tom630")) + lru.EntryOverhead},
+		{"key and value only", []GroupOption{WithCost(lru.KeyValueCost)}, int64(len("Tom630"))},
+		{"fixed", []GroupOption{WithCost(func(string, lru.Value) int64 { return 1000 })}, 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGroup("cost", 2<<10, 1, 30, GetterFunc(func(key string) ([]byte, error) {
+				return []byte(db[key]), nil
+			}), tc.opts...)
+			if _, err := g.Get("Tom"); err != nil {
+				t.Fatal(err)
+			}
+			if s := g.CacheStats(MainCache); s.Bytes != tc.bytes {
+				t.Fatalf("Tom is charged %d bytes, expect %d", s.Bytes, tc.bytes)
+			}
+		})
+	}
+}
+
+// TestMemoryBudget checks with runtime.MemStats that the default cost
+// keeps the heap taken by mainCache close to cacheBytes, see
+// lru.TestMemoryBudget for the slack allowed.
+func TestMemoryBudget(t *testing.T) {
+	const cacheBytes = 4 << 20
+	g := NewGroup("budget", cacheBytes, 1, 0, GetterFunc(func(key string) ([]byte, error) {
+		return nil, nil
+	}))
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100000; i++ {
+		g.mainCache.add(fmt.Sprintf("key%08d", i), ByteView{b: make([]byte, 100)})
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	used := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	if ratio := float64(used) / cacheBytes; ratio < 0.5 || ratio > 1.6 {
+		t.Fatalf("cache of %d entries takes %d bytes of heap, %.2f of cacheBytes", g.mainCache.stats().Items, used, ratio)
+	}
+	runtime.KeepAlive(g)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	loads := 0
+	getterFn := GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(db[key]), nil
+	})
+	// with the default LRU-K, k=2 would need a second load before caching
+	g := NewGroup("policy", 2<<10, 2, 30, getterFn,
+		WithEvictionPolicy(func() lru.EvictionPolicy { return lru.NewLRU() }))
+
+	for i := 0; i < 3; i++ {
+		if v, err := g.Get("Tom"); err != nil || v.String() != db["Tom"] {
+			t.Fatalf("failed to get value of Tom")
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("LRU policy should cache on first load, loads = %d", loads)
+	}
+	if s := g.CacheStats(MainCache); s.Items != 1 || s.HistoryItems != 0 {
+		t.Fatalf("unexpected main cache stats %+v", s)
+	}
+}
+
+func TestShards(t *testing.T) {
+	g := NewGroup("shards", 64<<10, 1, 30, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithShards(8))
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if v, err := g.Get(key); err != nil || v.String() != key {
+			t.Fatalf("failed to get %s", key)
+		}
+	}
+	s := g.CacheStats(MainCache)
+	if s.Items != 100 || s.MaxBytes != 64<<10 || s.Bytes != g.mainCache.stats().Bytes {
+		t.Fatalf("unexpected main cache stats %+v", s)
+	}
+	used := 0
+	for _, shard := range g.mainCache.shards {
+		if shard.store.Len() > 0 {
+			used++
+		}
+	}
+	if len(g.mainCache.shards) != 8 || used < 4 {
+		t.Fatalf("keys spread over %d of %d shards", used, len(g.mainCache.shards))
+	}
+
+	g.Remove("key1")
+	if _, ok := g.mainCache.get("key1"); ok {
+		t.Fatalf("key1 should be removed from its shard")
+	}
+}
+
+func TestShardsTinyCache(t *testing.T) {
+	// 4 bytes over 8 shards must not leave the shards unlimited
+	c := cache{cacheBytes: 4, nshards: 8, K: 1}
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("key%d", i), ByteView{b: []byte("v")})
+	}
+	if s := c.stats(); s.Items != 0 || s.Bytes > 4 {
+		t.Fatalf("a 4 byte cache holds %+v", s)
+	}
+}
+
+func TestLockFreeReads(t *testing.T) {
+	var loads int64
+	g := NewGroup("lockfree", 8<<10, 1, 30, GetterFunc(func(key string) ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return []byte(key), nil
+	}), WithLockFreeReads(), WithShards(4))
+	if _, ok := g.mainCache.shard("key").store.(*lru.ConcurrentCache); !ok {
+		t.Fatalf("mainCache should use lru.ConcurrentCache")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("key%d", j%20)
+				if v, err := g.Get(key); err != nil || v.String() != key {
+					t.Errorf("failed to get %s", key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if s := g.CacheStats(MainCache); s.Items != 20 || s.Hits == 0 {
+		t.Fatalf("unexpected main cache stats %+v", s)
+	}
+	if n := atomic.LoadInt64(&loads); n < 20 || n > 20*8 {
+		t.Fatalf("loaded %d times", n)
+	}
+}
+
+func TestSlabStorage(t *testing.T) {
+	var evicted int64
+	g := NewGroup("slab", 64<<10, 2, 30, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("v" + key), nil
+	}), WithSlabStorage(), WithShards(2), WithEvictedFunc(func(key string, value ByteView, reason lru.EvictReason) {
+		if reason != lru.EvictCapacity || value.String() != "v"+key {
+			t.Errorf("evicted %s=%s", key, value)
+		}
+		atomic.AddInt64(&evicted, 1)
+	}))
+	if _, ok := g.mainCache.shard("key").store.(*slabStore); !ok {
+		t.Fatalf("mainCache should use a slab store")
+	}
+	v, err := g.Get("key")
+	if err != nil || v.String() != "vkey" {
+		t.Fatalf("failed to get key")
+	}
+	if s := g.CacheStats(MainCache); s.Items != 1 {
+		t.Fatalf("slab storage should not wait for K references, %+v", s)
+	}
+	for i := 0; i < 10000; i++ {
+		if _, err := g.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := g.CacheStats(MainCache)
+	if s.Evictions == 0 || s.Evictions != atomic.LoadInt64(&evicted) || s.Bytes > s.MaxBytes {
+		t.Fatalf("unexpected main cache stats %+v, evicted %d", s, evicted)
+	}
+	if v.String() != "vkey" {
+		t.Fatalf("view changed to %s after eviction", v)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocache-l2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l2, err := disk.Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads int64
+	g := NewGroup("l2", 4<<10, 1, 0, GetterFunc(func(key string) ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return []byte("v" + key), nil
+	}), WithDiskCache(l2))
+	defer g.Close()
+	for i := 0; i < 100; i++ {
+		g.Get(fmt.Sprintf("key%d", i))
+	}
+	g.demoter.flush()
+	if s := g.CacheStats(MainCache); s.Evictions == 0 || int64(l2.Len()) != s.Evictions {
+		t.Fatalf("%d evicted values, %d on disk", s.Evictions, l2.Len())
+	}
+	if v, err := g.Get("key0"); err != nil || v.String() != "vkey0" {
+		t.Fatalf("failed to get key0 from disk")
+	}
+	if loads != 100 || g.Stats.DiskHits.Get() != 1 {
+		t.Fatalf("%d loads, %d disk hits", loads, g.Stats.DiskHits.Get())
+	}
+	// promoted back to memory
+	if _, ok := g.mainCache.get("key0"); !ok {
+		t.Fatalf("key0 should be promoted to mainCache")
+	}
+
+	g.Remove("key1")
+	if _, _, ok := l2.Get("key1"); ok {
+		t.Fatalf("key1 should be removed from disk")
+	}
+
+	// a value is found whether or not it reached the disk yet
+	g.demoter.add("queued", ByteView{b: []byte("vqueued")})
+	if v, err := g.Get("queued"); err != nil || v.String() != "vqueued" || loads != 100 {
+		t.Fatalf("failed to get a queued value, %d loads", loads)
+	}
+
+	// a value removed while waiting to be demoted is not written
+	g.demoter.add("pending", ByteView{b: []byte("stale")})
+	g.Remove("pending")
+	g.demoter.flush()
+	if _, _, ok := l2.Get("pending"); ok {
+		t.Fatalf("a removed value was demoted")
+	}
+	if _, ok := g.demoter.get("pending"); ok {
+		t.Fatalf("a removed value is still pending")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	var loads int64
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return []byte("v" + key), nil
+	})
+	g := NewGroup("snapshot", 16<<10, 2, 30, getter, WithTTL(time.Hour))
+	for _, key := range []string{"a", "b", "c"} {
+		g.Get(key)
+		g.Get(key)
+	}
+	g.Get("history")
+	for i := 0; i < 2; i++ {
+		g.mainCache.add("expired", ByteView{b: []byte("v"), e: time.Now().Add(-time.Second)})
+	}
+
+	var buf bytes.Buffer
+	if err := g.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	r := NewGroup("restored", 16<<10, 2, 30, getter)
+	if err := r.Restore(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.CacheStats(MainCache); s.Items != 3 || s.HistoryItems != 1 {
+		t.Fatalf("unexpected restored stats %+v", s)
+	}
+	loads = 0
+	for _, key := range []string{"a", "b", "c"} {
+		v, err := r.Get(key)
+		if err != nil || v.String() != "v"+key || v.Expire().IsZero() {
+			t.Fatalf("failed to get restored %s", key)
+		}
+	}
+	if loads != 0 {
+		t.Fatalf("restored values should not be loaded again")
+	}
+	// the history kept the first reference, the second one admits it
+	r.Get("history")
+	if _, ok := r.mainCache.get("history"); !ok {
+		t.Fatalf("history should be admitted on its second reference")
+	}
+	if !reflect.DeepEqual(itemKeys(r.mainCache.items()), []string{"a", "b", "c", "history"}) {
+		t.Fatalf("restored order %v", itemKeys(r.mainCache.items()))
+	}
+
+	damaged := append([]byte(nil), snapshot...)
+	damaged[len(damaged)/2] ^= 1
+	if err := r.Restore(bytes.NewReader(damaged)); err != ErrBadSnapshot {
+		t.Fatalf("damaged snapshot: %v", err)
+	}
+	if err := r.Restore(bytes.NewReader(snapshot[:len(snapshot)-1])); err != ErrBadSnapshot {
+		t.Fatalf("truncated snapshot: %v", err)
+	}
+	future := append([]byte(nil), snapshot...)
+	future[len(snapshotMagic)] = snapshotVersion + 1
+	if err := r.Restore(bytes.NewReader(future)); err == nil || err == ErrBadSnapshot {
+		t.Fatalf("unknown version: %v", err)
+	}
+}
+
+func itemKeys(items []lru.Item) []string {
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+// BenchmarkCacheGetParallel reads a warm cache from all CPUs, showing how
+// sharding removes the contention on a single mutex.
+func BenchmarkCacheGetParallel(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	for _, n := range []int{1, 4, 16, 64} {
+		for _, lockFree := range []bool{false, true} {
+			b.Run(fmt.Sprintf("shards=%d/lockfree=%v", n, lockFree), func(b *testing.B) {
+				c := &cache{cacheBytes: 1 << 20, K: 1, nshards: n, lockFree: lockFree}
+				for _, key := range keys {
+					c.add(key, ByteView{b: []byte(key)})
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						c.get(keys[i%len(keys)])
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+type fakePeer struct {
+	gets    int
+	removed []string
+}
+
+func (p *fakePeer) PickPeer(key string) (PeerGetter, bool) {
+	return p, true
+}
+
+func (p *fakePeer) Get(in *pb.Request, out *pb.Response) error {
+	p.gets++
+	out.Value = []byte("peer:" + in.GetKey())
+	return nil
+}
+
+func (p *fakePeer) Remove(in *pb.Request) error {
+	p.removed = append(p.removed, in.GetGroup()+"/"+in.GetKey())
+	return nil
+}
+
+func TestRemove(t *testing.T) {
+	loads := 0
+	g := NewGroup("remove", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}))
+
+	g.Get("Tom")
+	if err := g.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("Tom should be removed from mainCache")
+	}
+	g.Get("Tom")
+	if loads != 2 {
+		t.Fatalf("Tom should be reloaded after Remove, loads = %d", loads)
+	}
+
+	peer := &fakePeer{}
+	g.RegisterPeers(peer)
+	if err := g.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if len(peer.removed) != 1 || peer.removed[0] != "remove/Tom" {
+		t.Fatalf("Remove not forwarded to owner, got %v", peer.removed)
+	}
+
+	// the local copy goes even when the owner cannot drop its own
+	g.mainCache.add("Tom", ByteView{b: []byte("Tom")})
+	g.peers = &getOnlyPeer{}
+	if err := g.Remove("Tom"); err != errRemoveUnsupported {
+		t.Fatalf("expect errRemoveUnsupported, got %v", err)
+	}
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("Tom should be removed from mainCache")
+	}
+}
+
+// getOnlyPeer implements neither PeerRemover nor ContextPeerRemover
+type getOnlyPeer struct{}
+
+func (p *getOnlyPeer) PickPeer(key string) (PeerGetter, bool) {
+	return p, true
+}
+
+func (p *getOnlyPeer) Get(in *pb.Request, out *pb.Response) error {
+	out.Value = []byte("peer:" + in.GetKey())
+	return nil
+}
+
+func TestHotCache(t *testing.T) {
+	g := NewGroup("hot", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}), WithHotCache(0.5, 1))
+	peer := &fakePeer{}
+	g.RegisterPeers(peer)
+
+	for i := 0; i < 3; i++ {
+		if v, err := g.Get("Tom"); err != nil || v.String() != "peer:Tom" {
+			t.Fatalf("failed to get Tom from peer: %v", err)
+		}
+	}
+	if peer.gets != 1 {
+		t.Fatalf("hot key should be served from hotCache, peer gets = %d", peer.gets)
+	}
+	if s := g.CacheStats(HotCache); s.Hits != 2 || s.Misses() != 1 {
+		t.Fatalf("unexpected hotCache stats %+v", s)
+	}
+	if s := g.CacheStats(MainCache); s.Hits != 0 || s.Gets != 3 {
+		t.Fatalf("peer values must not enter mainCache, stats %+v", s)
+	}
+
+	g.Remove("Tom")
+	if _, ok := g.hotCache.get("Tom"); ok {
+		t.Fatalf("Remove should drop the hot copy")
+	}
+}
+
+func TestLoadsDeduped(t *testing.T) {
+	release := make(chan struct{})
+	g := NewGroup("dedup", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			<-release
+			return []byte(key), nil
+		}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.Get("Tom")
+		}()
+	}
+	// let every caller join the in-flight load before it finishes
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := g.Stats.LocalLoads.Get(); n != 1 {
+		t.Fatalf("LocalLoads = %d, expect 1", n)
+	}
+	if n := g.Stats.LoadsDeduped.Get(); n != 4 {
+		t.Fatalf("LoadsDeduped = %d, expect 4", n)
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	g := NewGroup("context", 2<<10, 1, 30, ContextGetterFunc(
+		func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			select {
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			case <-time.After(time.Second):
+				return []byte(key), 0, nil
+			}
+		}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.GetContext(ctx, "Tom"); err != context.DeadlineExceeded {
+		t.Fatalf("GetContext should stop at the deadline, got %v", err)
+	}
+	if g.Stats.LocalLoadErrs.Get() != 1 {
+		t.Fatalf("a canceled load should count as a local load error")
+	}
+}
+
+func TestGetSink(t *testing.T) {
+	loads := 0
+	g := NewGroup("sink", 2<<10, 1, 30, SinkGetterFunc(
+		func(ctx context.Context, key string, dest Sink) error {
+			loads++
+			return dest.SetProto(&pb.Request{Group: "sink", Key: key}, time.Time{})
+		}), WithTTL(time.Hour))
+
+	var msg pb.Request
+	if err := g.GetSink(context.Background(), "Tom", ProtoSink(&msg)); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetKey() != "Tom" || msg.GetGroup() != "sink" {
+		t.Fatalf("ProtoSink got %v", &msg)
+	}
+
+	var b []byte
+	if err := g.GetSink(context.Background(), "Tom", AllocatingByteSliceSink(&b)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	var s string
+	if err := g.GetSink(context.Background(), "Tom", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	var again pb.Request
+	if err := proto.Unmarshal([]byte(s), &again); err != nil || again.GetKey() != "Tom" {
+		t.Fatalf("cached bytes were changed through AllocatingByteSliceSink: %v", err)
+	}
+
+	var v ByteView
+	if err := g.GetSink(context.Background(), "Tom", ByteViewSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if v.Expire().IsZero() {
+		t.Fatalf("default ttl should apply to values set without expire")
+	}
+	if loads != 1 {
+		t.Fatalf("Tom should be loaded once, loads = %d", loads)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	loads := 0
+	g := NewGroup("negative", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+		}), WithNegativeTTL(20*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expect ErrNotFound, got %v", err)
+		}
+	}
+	if loads != 1 || g.Stats.NegativeHits.Get() != 2 || g.Stats.CacheHits.Get() != 0 {
+		t.Fatalf("loads = %d, negative hits = %d", loads, g.Stats.NegativeHits.Get())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	g.Get("unknown")
+	if loads != 2 {
+		t.Fatalf("negative entry should expire, loads = %d", loads)
+	}
+}
+
+func TestNegativeCacheCost(t *testing.T) {
+	// 1/16 of 2 KiB is less than one entry charged with the default
+	// EstimatedCost, negCache is given room for a few anyway
+	loads := 0
+	g := NewGroup("negative-cost", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+		}), WithNegativeTTL(time.Minute))
+	g.Get("unknown")
+	g.Get("unknown")
+	if loads != 1 || g.Stats.NegativeHits.Get() != 1 {
+		t.Fatalf("loads = %d, negative hits = %d", loads, g.Stats.NegativeHits.Get())
+	}
+	if s := g.negCache.stats(); s.Bytes != int64(len("unknown"))+lru.EntryOverhead {
+		t.Fatalf("negative entry is charged %d bytes", s.Bytes)
+	}
+}
+
+type notFoundPeer struct {
+	fakePeer
+}
+
+func (p *notFoundPeer) PickPeer(key string) (PeerGetter, bool) {
+	return p, true
+}
+
+func (p *notFoundPeer) Get(in *pb.Request, out *pb.Response) error {
+	p.gets++
+	out.NotFound = true
+	return nil
+}
+
+func TestNegativeCacheFromPeer(t *testing.T) {
+	g := NewGroup("negative-peer", 2<<10, 1, 30, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("the owner said %s does not exist", key)
+		}), WithNegativeTTL(time.Minute))
+	peer := &notFoundPeer{}
+	g.RegisterPeers(peer)
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Get("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expect ErrNotFound, got %v", err)
+		}
+	}
+	if peer.gets != 1 || g.Stats.LocalLoads.Get()+g.Stats.LocalLoadErrs.Get() != 0 {
+		t.Fatalf("peer gets = %d, the Getter must not be called", peer.gets)
+	}
+}
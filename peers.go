@@ -1,6 +1,11 @@
 package ocache
 
-import pb "ocache/ocachepb"
+import (
+	"context"
+	"errors"
+	pb "ocache/ocachepb"
+	"time"
+)
 
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
@@ -13,3 +18,77 @@ type PeerPicker interface {
 type PeerGetter interface {
 	Get(in *pb.Request, out *pb.Response) error
 }
+
+// ContextPeerGetter is the context-aware form of PeerGetter. Peers that
+// implement it get the ctx of the request that caused the call.
+type ContextPeerGetter interface {
+	GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error
+}
+
+// PeerRemover is implemented by peers that Group.Remove can forward an
+// invalidation to.
+type PeerRemover interface {
+	// Remove drops in.Key from the peer's copy of in.Group.
+	Remove(in *pb.Request) error
+}
+
+// ContextPeerRemover is the context-aware form of PeerRemover.
+type ContextPeerRemover interface {
+	RemoveContext(ctx context.Context, in *pb.Request) error
+}
+
+// errRemoveUnsupported is returned when the owner of a key implements
+// neither PeerRemover nor ContextPeerRemover
+var errRemoveUnsupported = errors.New("peer does not support Remove")
+
+// peerGet calls peer with ctx when it supports one
+func peerGet(ctx context.Context, peer PeerGetter, in *pb.Request, out *pb.Response) error {
+	if cp, ok := peer.(ContextPeerGetter); ok {
+		return cp.GetContext(ctx, in, out)
+	}
+	return peer.Get(in, out)
+}
+
+// peerRemove calls peer with ctx when it supports one
+func peerRemove(ctx context.Context, peer PeerGetter, in *pb.Request) error {
+	switch p := peer.(type) {
+	case ContextPeerRemover:
+		return p.RemoveContext(ctx, in)
+	case PeerRemover:
+		return p.Remove(in)
+	}
+	return errRemoveUnsupported
+}
+
+// newResponse packs a cached view into a peer response
+func newResponse(view ByteView) *pb.Response {
+	res := &pb.Response{Value: view.ByteSlice()}
+	if e := view.Expire(); !e.IsZero() {
+		res.Expire = e.UnixNano()
+	}
+	return res
+}
+
+// serveGet answers a Get from a peer. ErrNotFound, and ErrBloomRejected
+// which proves the same, are answered in the response, so the caller does
+// not take them for a failed peer and ask its Getter. Other errors are
+// left to the transport to report.
+func serveGet(ctx context.Context, group *Group, key string) (*pb.Response, error) {
+	view, err := group.GetContext(ctx, key)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrBloomRejected) {
+		return &pb.Response{NotFound: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(view), nil
+}
+
+// viewFromResponse unpacks a peer response into a view
+func viewFromResponse(res *pb.Response) ByteView {
+	value := ByteView{b: res.Value}
+	if res.Expire != 0 {
+		value.e = time.Unix(0, res.Expire)
+	}
+	return value
+}
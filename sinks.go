@@ -0,0 +1,226 @@
+package ocache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// A Sink receives data from a Get call.
+//
+// Implementation of Getter must call exactly one of the Set methods
+// on success. The expire passed along is the deadline of the value,
+// the zero time falls back to the Group's default TTL.
+type Sink interface {
+	// SetString sets the value to s.
+	SetString(s string, expire time.Time) error
+
+	// SetBytes sets the value to the contents of v.
+	// The caller retains ownership of v.
+	SetBytes(v []byte, expire time.Time) error
+
+	// SetProto sets the value to the encoded version of m.
+	// The caller retains ownership of m.
+	SetProto(m proto.Message, expire time.Time) error
+
+	// view returns a frozen view of the bytes for caching.
+	view() (ByteView, error)
+}
+
+// A SinkGetter loads data for a key into dest, so it can hand over a
+// string, bytes or a proto.Message without converting it first.
+type SinkGetter interface {
+	GetSink(ctx context.Context, key string, dest Sink) error
+}
+
+// A SinkGetterFunc implements Getter and SinkGetter with a function.
+type SinkGetterFunc func(ctx context.Context, key string, dest Sink) error
+
+// GetSink implements SinkGetter interface function
+func (f SinkGetterFunc) GetSink(ctx context.Context, key string, dest Sink) error {
+	return f(ctx, key, dest)
+}
+
+// Get implements Getter interface function with a background context
+func (f SinkGetterFunc) Get(key string) ([]byte, error) {
+	var b []byte
+	err := f(context.Background(), key, AllocatingByteSliceSink(&b))
+	return b, err
+}
+
+// setSinkView hands a cached view to dest, skipping the copy when dest
+// can hold a ByteView itself.
+func setSinkView(dest Sink, v ByteView) error {
+	if vs, ok := dest.(viewSetter); ok {
+		return vs.setView(v)
+	}
+	return dest.SetBytes(v.b, v.e)
+}
+
+// viewSetter is implemented by sinks that can take a ByteView without copying
+type viewSetter interface {
+	setView(v ByteView) error
+}
+
+// StringSink returns a Sink that populates the provided string pointer.
+func StringSink(sp *string) Sink {
+	return &stringSink{sp: sp}
+}
+
+type stringSink struct {
+	sp *string
+	v  ByteView
+}
+
+func (s *stringSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *stringSink) setView(v ByteView) error {
+	*s.sp = v.String()
+	s.v = v
+	return nil
+}
+
+func (s *stringSink) SetString(v string, e time.Time) error {
+	return s.setView(ByteView{b: []byte(v), e: e})
+}
+
+func (s *stringSink) SetBytes(v []byte, e time.Time) error {
+	return s.setView(ByteView{b: cloneBytes(v), e: e})
+}
+
+func (s *stringSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setView(ByteView{b: b, e: e})
+}
+
+// ByteViewSink returns a Sink that populates a ByteView.
+func ByteViewSink(dst *ByteView) Sink {
+	if dst == nil {
+		panic("nil dst")
+	}
+	return &byteViewSink{dst: dst}
+}
+
+type byteViewSink struct {
+	dst *ByteView
+}
+
+func (s *byteViewSink) view() (ByteView, error) {
+	return *s.dst, nil
+}
+
+func (s *byteViewSink) setView(v ByteView) error {
+	*s.dst = v
+	return nil
+}
+
+func (s *byteViewSink) SetString(v string, e time.Time) error {
+	return s.setView(ByteView{b: []byte(v), e: e})
+}
+
+func (s *byteViewSink) SetBytes(v []byte, e time.Time) error {
+	return s.setView(ByteView{b: cloneBytes(v), e: e})
+}
+
+func (s *byteViewSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setView(ByteView{b: b, e: e})
+}
+
+// AllocatingByteSliceSink returns a Sink that allocates
+// a byte slice to hold the received value and assigns
+// it to *dst. The memory is not retained by ocache.
+func AllocatingByteSliceSink(dst *[]byte) Sink {
+	return &allocBytesSink{dst: dst}
+}
+
+type allocBytesSink struct {
+	dst *[]byte
+	v   ByteView
+}
+
+func (s *allocBytesSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *allocBytesSink) setView(v ByteView) error {
+	*s.dst = cloneBytes(v.b)
+	s.v = v
+	return nil
+}
+
+func (s *allocBytesSink) SetString(v string, e time.Time) error {
+	return s.setBytesOwned([]byte(v), e)
+}
+
+func (s *allocBytesSink) SetBytes(v []byte, e time.Time) error {
+	return s.setBytesOwned(cloneBytes(v), e)
+}
+
+func (s *allocBytesSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setBytesOwned(b, e)
+}
+
+// setBytesOwned keeps b as the cached form and gives the caller its own copy
+func (s *allocBytesSink) setBytesOwned(b []byte, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil AllocatingByteSliceSink *[]byte dst")
+	}
+	*s.dst = cloneBytes(b)
+	s.v = ByteView{b: b, e: e}
+	return nil
+}
+
+// ProtoSink returns a sink that unmarshals binary proto values into m.
+func ProtoSink(m proto.Message) Sink {
+	return &protoSink{dst: m}
+}
+
+type protoSink struct {
+	dst proto.Message // authoritative value
+	v   ByteView
+}
+
+func (s *protoSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+// setView unmarshals straight from the cached bytes, which proto
+// does not retain, so no copy is needed
+func (s *protoSink) setView(v ByteView) error {
+	if err := proto.Unmarshal(v.b, s.dst); err != nil {
+		return err
+	}
+	s.v = v
+	return nil
+}
+
+func (s *protoSink) SetBytes(b []byte, e time.Time) error {
+	return s.setView(ByteView{b: cloneBytes(b), e: e})
+}
+
+func (s *protoSink) SetString(v string, e time.Time) error {
+	return s.setView(ByteView{b: []byte(v), e: e})
+}
+
+func (s *protoSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setView(ByteView{b: b, e: e})
+}
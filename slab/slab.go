@@ -0,0 +1,319 @@
+package slab
+
+import (
+	"encoding/binary"
+	"ocache/lru"
+	"sync"
+	"time"
+)
+
+// Cache packs keys and values into large byte segments, like BigCache
+// and FreeCache, so that a cache of millions of values is a few big
+// []byte and a map of integers for the garbage collector, none of which
+// it has to scan.
+//
+// Records are appended to the newest segment. When the segments are all
+// in use the oldest one is evicted as a whole, FIFO, and written over, so
+// a bounded cache allocates no segment once it is full. Get returns a
+// copy of a value, the values passed to onEvicted and Range point into a
+// segment and are only valid during the call.
+type Cache struct {
+	mu        sync.RWMutex
+	index     map[uint64]uint64 // key hash -> location of its record, free of pointers
+	segs      [][]byte          // ring of segments, segment seq lives in segs[seq%len(segs)]
+	fill      []int             // bytes written to each segment
+	segSize   int
+	bounded   bool   // false when maxBytes is 0, segments are then only added
+	head      uint64 // seq of the segment being written
+	tail      uint64 // seq of the oldest segment
+	off       int    // write offset in the head segment
+	maxBytes  int64
+	nbytes    int64 // bytes of live records
+	nitems    int64
+	nevict    int64
+	onEvicted func(key string, value []byte, expire time.Time, reason lru.EvictReason)
+}
+
+const (
+	// MaxSegmentSize bounds a segment, a record must fit in one
+	MaxSegmentSize = 1 << 20
+	// minSegments is how many segments a bounded cache is split into at least
+	minSegments = 8
+	// headerSize is the expire (unix nanoseconds), key and value lengths of a record
+	headerSize = 16
+)
+
+// New creates a Cache taking about maxBytes in segments, 0 means
+// unlimited. onEvicted is optional and called when a live record is
+// evicted or removed, not when it is replaced by an Add.
+func New(maxBytes int64, onEvicted func(key string, value []byte, expire time.Time, reason lru.EvictReason)) *Cache {
+	c := &Cache{
+		index:     make(map[uint64]uint64),
+		segSize:   MaxSegmentSize,
+		bounded:   maxBytes > 0,
+		maxBytes:  maxBytes,
+		onEvicted: onEvicted,
+	}
+	if c.bounded {
+		if int64(c.segSize)*minSegments > maxBytes {
+			c.segSize = int(maxBytes / minSegments)
+		}
+		if c.segSize < headerSize {
+			c.segSize = headerSize
+		}
+		n := maxBytes / int64(c.segSize)
+		if n < 1 {
+			n = 1
+		}
+		// the segments are allocated as they are first written
+		c.segs = make([][]byte, n)
+	} else {
+		c.segs = make([][]byte, 1)
+	}
+	c.fill = make([]int, len(c.segs))
+	c.segs[0] = make([]byte, c.segSize)
+	return c
+}
+
+// location packs the slot of a segment in segs and an offset into an
+// index value. Records of an evicted segment leave the index with it, so
+// the slot alone identifies the segment.
+func location(slot uint64, off int) uint64 {
+	return slot<<32 | uint64(off)
+}
+
+func (c *Cache) slot(seq uint64) uint64 {
+	return seq % uint64(len(c.segs))
+}
+
+func hashKey(key string) uint64 {
+	// inline FNV-1a, hash/fnv would allocate on every call
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// record returns the segment and bounds of the record at loc
+func (c *Cache) record(loc uint64) (seg []byte, off, klen, vlen int) {
+	off = int(loc & 0xffffffff)
+	seg = c.segs[loc>>32]
+	klen = int(binary.LittleEndian.Uint32(seg[off+8:]))
+	vlen = int(binary.LittleEndian.Uint32(seg[off+12:]))
+	return seg, off, klen, vlen
+}
+
+func recordExpire(seg []byte, off int) time.Time {
+	if n := int64(binary.LittleEndian.Uint64(seg[off:])); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// Get returns a copy of the value of key and its deadline.
+func (c *Cache) Get(key string) (value []byte, expire time.Time, ok bool) {
+	h := hashKey(key)
+	c.mu.RLock()
+	loc, ok := c.index[h]
+	if !ok {
+		c.mu.RUnlock()
+		return nil, time.Time{}, false
+	}
+	seg, off, klen, vlen := c.record(loc)
+	if string(seg[off+headerSize:off+headerSize+klen]) != key {
+		// another key with the same hash took the slot
+		c.mu.RUnlock()
+		return nil, time.Time{}, false
+	}
+	expire = recordExpire(seg, off)
+	start := off + headerSize + klen
+	// copied under the lock, the segment may be written over once it is
+	// released
+	value = make([]byte, vlen)
+	copy(value, seg[start:start+vlen])
+	c.mu.RUnlock()
+
+	if !expire.IsZero() && time.Now().After(expire) {
+		c.mu.Lock()
+		if c.index[h] == loc {
+			c.removeRecord(h, loc, lru.EvictExpired)
+		}
+		c.mu.Unlock()
+		return nil, time.Time{}, false
+	}
+	return value, expire, true
+}
+
+// Add stores a copy of value for key until expire, a zero expire means
+// it never expires. A record larger than a segment is not stored.
+func (c *Cache) Add(key string, value []byte, expire time.Time) {
+	h := hashKey(key)
+	size := headerSize + len(key) + len(value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.index[h]; ok {
+		// the old record becomes dead space in its segment
+		c.dropRecord(h, old)
+	}
+	if size > c.segSize {
+		return
+	}
+	if c.off+size > c.segSize {
+		c.advance()
+	}
+	slot := c.slot(c.head)
+	seg := c.segs[slot]
+	var n int64
+	if !expire.IsZero() {
+		n = expire.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(seg[c.off:], uint64(n))
+	binary.LittleEndian.PutUint32(seg[c.off+8:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(seg[c.off+12:], uint32(len(value)))
+	copy(seg[c.off+headerSize:], key)
+	copy(seg[c.off+headerSize+len(key):], value)
+	c.index[h] = location(slot, c.off)
+	c.off += size
+	c.fill[slot] = c.off
+	c.nbytes += int64(size)
+	c.nitems++
+}
+
+// advance moves writing to the next segment, evicting the oldest one
+// and writing over it if all are in use. An unbounded cache only adds
+// segments.
+func (c *Cache) advance() {
+	c.head++
+	c.off = 0
+	if !c.bounded {
+		c.segs = append(c.segs, make([]byte, c.segSize))
+		c.fill = append(c.fill, 0)
+		return
+	}
+	if c.head-c.tail >= uint64(len(c.segs)) {
+		c.evictSegment(c.slot(c.tail))
+		c.tail++
+	}
+	slot := c.slot(c.head)
+	if c.segs[slot] == nil {
+		c.segs[slot] = make([]byte, c.segSize)
+	}
+	c.fill[slot] = 0
+}
+
+// evictSegment drops every live record of the segment in slot
+func (c *Cache) evictSegment(slot uint64) {
+	seg := c.segs[slot]
+	for off := 0; off < c.fill[slot]; {
+		klen := int(binary.LittleEndian.Uint32(seg[off+8:]))
+		vlen := int(binary.LittleEndian.Uint32(seg[off+12:]))
+		h := hashKey(string(seg[off+headerSize : off+headerSize+klen]))
+		if loc := location(slot, off); c.index[h] == loc {
+			c.removeRecord(h, loc, lru.EvictCapacity)
+		}
+		off += headerSize + klen + vlen
+	}
+}
+
+// dropRecord forgets the record of hash h at loc, c.mu must be held
+func (c *Cache) dropRecord(h, loc uint64) {
+	_, _, klen, vlen := c.record(loc)
+	delete(c.index, h)
+	c.nbytes -= int64(headerSize + klen + vlen)
+	c.nitems--
+}
+
+// removeRecord drops the record of hash h at loc and reports it to
+// onEvicted, c.mu must be held
+func (c *Cache) removeRecord(h, loc uint64, reason lru.EvictReason) {
+	c.dropRecord(h, loc)
+	if reason != lru.EvictRemoved {
+		c.nevict++
+	}
+	if c.onEvicted != nil {
+		seg, off, klen, vlen := c.record(loc)
+		start := off + headerSize + klen
+		c.onEvicted(string(seg[off+headerSize:start]), seg[start:start+vlen:start+vlen], recordExpire(seg, off), reason)
+	}
+}
+
+// Remove deletes key from the cache
+func (c *Cache) Remove(key string) {
+	h := hashKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loc, ok := c.index[h]
+	if !ok {
+		return
+	}
+	seg, off, klen, _ := c.record(loc)
+	if string(seg[off+headerSize:off+headerSize+klen]) == key {
+		c.removeRecord(h, loc, lru.EvictRemoved)
+	}
+}
+
+// RemoveExpired drops every record whose deadline is before now and
+// returns how many were removed.
+func (c *Cache) RemoveExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for h, loc := range c.index {
+		seg, off, _, _ := c.record(loc)
+		if expire := recordExpire(seg, off); !expire.IsZero() && now.After(expire) {
+			c.removeRecord(h, loc, lru.EvictExpired)
+			n++
+		}
+	}
+	return n
+}
+
+// Range calls fn for every live record, oldest first, until fn returns
+// false. value points into a segment and is only valid during the call,
+// fn must not call c.
+func (c *Cache) Range(fn func(key string, value []byte, expire time.Time) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for seq := c.tail; seq <= c.head; seq++ {
+		slot := c.slot(seq)
+		seg := c.segs[slot]
+		for off := 0; off < c.fill[slot]; {
+			klen := int(binary.LittleEndian.Uint32(seg[off+8:]))
+			vlen := int(binary.LittleEndian.Uint32(seg[off+12:]))
+			key := string(seg[off+headerSize : off+headerSize+klen])
+			if c.index[hashKey(key)] == location(slot, off) {
+				start := off + headerSize + klen
+				if !fn(key, seg[start:start+vlen:start+vlen], recordExpire(seg, off)) {
+					return
+				}
+			}
+			off += headerSize + klen + vlen
+		}
+	}
+}
+
+// GetNBytes returns the bytes taken by live records, headers included
+func (c *Cache) GetNBytes() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nbytes
+}
+
+func (c *Cache) GetMaxBytes() int64 {
+	return c.maxBytes
+}
+
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return int(c.nitems)
+}
+
+// Evictions returns how many records were dropped for capacity or expiry
+func (c *Cache) Evictions() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nevict
+}
@@ -0,0 +1,230 @@
+package slab
+
+import (
+	"fmt"
+	"ocache/lru"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	c := New(0, nil)
+	c.Add("key1", []byte("1234"), time.Time{})
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, _, ok := c.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+	c.Add("key1", []byte("5678"), time.Time{})
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "5678" {
+		t.Fatalf("overwrite key1=5678 failed")
+	}
+	if c.Len() != 1 || c.GetNBytes() != headerSize+4+4 {
+		t.Fatalf("len %d, bytes %d", c.Len(), c.GetNBytes())
+	}
+	c.Remove("key1")
+	if _, _, ok := c.Get("key1"); ok || c.Len() != 0 || c.GetNBytes() != 0 {
+		t.Fatalf("key1 should be removed")
+	}
+}
+
+func TestUnbounded(t *testing.T) {
+	c := New(0, nil)
+	value := make([]byte, 100<<10)
+	for i := 0; i < 50; i++ {
+		c.Add(strconv.Itoa(i), value, time.Time{})
+	}
+	for i := 0; i < 50; i++ {
+		if v, _, ok := c.Get(strconv.Itoa(i)); !ok || len(v) != len(value) {
+			t.Fatalf("lost key %d", i)
+		}
+	}
+	if c.Evictions() != 0 {
+		t.Fatalf("unbounded cache evicted %d", c.Evictions())
+	}
+}
+
+func TestEvictSegment(t *testing.T) {
+	var evicted []string
+	c := New(8<<10, func(key string, value []byte, expire time.Time, reason lru.EvictReason) {
+		if reason != lru.EvictCapacity || string(value) != "v"+key {
+			t.Errorf("unexpected eviction of %s=%s for %v", key, value, reason)
+		}
+		evicted = append(evicted, key)
+	})
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		c.Add(key, []byte("v"+key), time.Time{})
+	}
+	if len(evicted) == 0 || int64(len(evicted)) != c.Evictions() {
+		t.Fatalf("evicted %d, counted %d", len(evicted), c.Evictions())
+	}
+	// FIFO: the oldest keys go first, the newest are still there
+	for i, key := range evicted {
+		if key != strconv.Itoa(i) {
+			t.Fatalf("evicted %s at %d", key, i)
+		}
+	}
+	if v, _, ok := c.Get("999"); !ok || string(v) != "v999" {
+		t.Fatalf("newest key lost")
+	}
+	if c.Len()+len(evicted) != 1000 || c.GetNBytes() > c.GetMaxBytes() {
+		t.Fatalf("len %d, bytes %d of %d", c.Len(), c.GetNBytes(), c.GetMaxBytes())
+	}
+}
+
+// TestEvictedView checks a value returned by Get is not overwritten once
+// its segment is evicted and written over
+func TestEvictedView(t *testing.T) {
+	c := New(4<<10, nil)
+	c.Add("key", []byte("value"), time.Time{})
+	v, _, _ := c.Get("key")
+	for i := 0; i < 1000; i++ {
+		c.Add(strconv.Itoa(i), []byte("xxxxxxxxxx"), time.Time{})
+	}
+	if _, _, ok := c.Get("key"); ok {
+		t.Fatalf("key should be evicted")
+	}
+	if string(v) != "value" {
+		t.Fatalf("view changed to %q", v)
+	}
+	if len(v) != cap(v) {
+		t.Fatalf("view should not reach into the next record")
+	}
+}
+
+// TestReuseSegments checks a full cache writes over its evicted segments
+// instead of allocating new ones
+func TestReuseSegments(t *testing.T) {
+	c := New(4<<10, nil)
+	add := func() {
+		for i := 0; i < 1000; i++ {
+			c.Add(strconv.Itoa(i), []byte("xxxxxxxxxx"), time.Time{})
+		}
+	}
+	add()
+	segs := make([]*byte, len(c.segs))
+	for i, seg := range c.segs {
+		if seg == nil {
+			t.Fatalf("segment %d unused after filling the cache", i)
+		}
+		segs[i] = &seg[0]
+	}
+	add()
+	for i, seg := range c.segs {
+		if &seg[0] != segs[i] {
+			t.Fatalf("segment %d was allocated again", i)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	c := New(4<<10, nil)
+	for i := 0; i < 1000; i++ {
+		c.Add(strconv.Itoa(i%300), []byte(strconv.Itoa(i)), time.Time{})
+	}
+	var keys []string
+	c.Range(func(key string, value []byte, expire time.Time) bool {
+		if n, _ := strconv.Atoi(string(value)); strconv.Itoa(n%300) != key {
+			t.Fatalf("%s=%s", key, value)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != c.Len() {
+		t.Fatalf("ranged over %d of %d records", len(keys), c.Len())
+	}
+	// oldest first
+	for i, key := range keys {
+		if want := strconv.Itoa((1000 - len(keys) + i) % 300); key != want {
+			t.Fatalf("record %d is %s, want %s", i, key, want)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	var expired []string
+	c := New(0, func(key string, value []byte, expire time.Time, reason lru.EvictReason) {
+		if reason == lru.EvictExpired {
+			expired = append(expired, key)
+		}
+	})
+	deadline := time.Now().Add(50 * time.Millisecond)
+	c.Add("k1", []byte("1"), deadline)
+	c.Add("k2", []byte("2"), deadline)
+	c.Add("k3", []byte("3"), time.Time{})
+	if _, e, ok := c.Get("k1"); !ok || !e.Equal(deadline) {
+		t.Fatalf("k1 should not have expired, deadline %v", e)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, _, ok := c.Get("k1"); ok {
+		t.Fatalf("k1 should have expired")
+	}
+	if n := c.RemoveExpired(time.Now()); n != 1 {
+		t.Fatalf("removed %d expired", n)
+	}
+	if c.Len() != 1 || len(expired) != 2 || c.Evictions() != 2 {
+		t.Fatalf("len %d, expired %v", c.Len(), expired)
+	}
+}
+
+// lruValue is the []byte value of an lru.Cache
+type lruValue []byte
+
+func (v lruValue) Len() int { return len(v) }
+
+// BenchmarkGCPause fills an lru.Cache and a slab.Cache with the same
+// entries and reports the pause and duration of a full garbage collection
+// while the cache is alive. The lru.Cache is pointers all the way down.
+func BenchmarkGCPause(b *testing.B) {
+	const n = 1 << 20
+	value := make([]byte, 64)
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	caches := []struct {
+		name string
+		add  func() interface{}
+	}{
+		{"lru", func() interface{} {
+			c := lru.New(1, 0, 0, nil)
+			for _, key := range keys {
+				c.Add(key, lruValue(append([]byte(nil), value...)))
+			}
+			return c
+		}},
+		{"slab", func() interface{} {
+			c := New(0, nil)
+			for _, key := range keys {
+				c.Add(key, value, time.Time{})
+			}
+			return c
+		}},
+	}
+	for _, c := range caches {
+		b.Run(c.name, func(b *testing.B) {
+			cache := c.add()
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			start := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			b.StopTimer()
+			elapsed := time.Since(start)
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(cache)
+			gcs := int64(after.NumGC - before.NumGC)
+			if gcs > 0 {
+				b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(gcs), "pause-ns/gc")
+				b.ReportMetric(float64(elapsed.Nanoseconds())/float64(gcs), "ns/gc")
+			}
+		})
+	}
+}
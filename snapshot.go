@@ -0,0 +1,222 @@
+package ocache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"ocache/lru"
+	"time"
+)
+
+// A snapshot is the magic, a version byte, then one record per history
+// key or entry of mainCache, least recently used first, and an end
+// record followed by the CRC-32C of everything before it.
+//
+//	history: recordHistory, key, refs
+//	entry:   recordEntry, key, expire (unix nanoseconds, 0 for never), value, refs
+//	end:     recordEnd, crc (4 bytes, big endian)
+//
+// Strings and byte slices are a uvarint length and the bytes, refs are a
+// uvarint count and as many uvarint LRU-K reference times.
+const (
+	snapshotMagic   = "OCSN"
+	snapshotVersion = 1
+
+	recordEnd     = 0
+	recordEntry   = 1
+	recordHistory = 2
+)
+
+// ErrBadSnapshot is returned by Restore for data that was not written by
+// Snapshot or was damaged since.
+var ErrBadSnapshot = errors.New("corrupted snapshot")
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Snapshot writes the values of mainCache with their deadlines, and the
+// LRU-K reference history, to w in recency order. The values are listed
+// shard by shard, least recently used first within each shard.
+func (g *Group) Snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(snapshotTable)
+	sw := snapshotWriter{w: io.MultiWriter(bw, crc)}
+	sw.write([]byte(snapshotMagic))
+	sw.write([]byte{snapshotVersion})
+	for _, item := range g.mainCache.items() {
+		if item.Value == nil {
+			sw.write([]byte{recordHistory})
+			sw.bytes([]byte(item.Key))
+		} else {
+			sw.write([]byte{recordEntry})
+			sw.bytes([]byte(item.Key))
+			var expire int64
+			if !item.Expire.IsZero() {
+				expire = item.Expire.UnixNano()
+			}
+			sw.varint(expire)
+			sw.bytes(item.Value.(ByteView).b)
+		}
+		sw.uvarint(uint64(len(item.Refs)))
+		for _, ref := range item.Refs {
+			sw.uvarint(ref)
+		}
+	}
+	sw.write([]byte{recordEnd})
+	if sw.err != nil {
+		return sw.err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	if _, err := bw.Write(sum[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// snapshotWriter keeps the first error, so the encoding reads straight
+type snapshotWriter struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) uvarint(v uint64) {
+	sw.write(sw.buf[:binary.PutUvarint(sw.buf[:], v)])
+}
+
+func (sw *snapshotWriter) varint(v int64) {
+	sw.write(sw.buf[:binary.PutVarint(sw.buf[:], v)])
+}
+
+func (sw *snapshotWriter) bytes(b []byte) {
+	sw.uvarint(uint64(len(b)))
+	sw.write(b)
+}
+
+// Restore loads a snapshot written by Snapshot into mainCache, in the
+// order it was written, so the most recently used values are the last to
+// be evicted. Expired values are skipped. The whole snapshot is checked
+// before anything is restored, it is meant for a Group that has not
+// served requests yet.
+func (g *Group) Restore(r io.Reader) error {
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.New(snapshotTable)}
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(sr, header); err != nil {
+		return snapshotError(err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrBadSnapshot
+	}
+	if v := header[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	var items []lru.Item
+	for {
+		kind, err := sr.ReadByte()
+		if err != nil {
+			return snapshotError(err)
+		}
+		if kind == recordEnd {
+			break
+		}
+		if kind != recordEntry && kind != recordHistory {
+			return ErrBadSnapshot
+		}
+		key, err := sr.bytes()
+		if err != nil {
+			return snapshotError(err)
+		}
+		item := lru.Item{Key: string(key)}
+		if kind == recordEntry {
+			expire, err := binary.ReadVarint(sr)
+			if err != nil {
+				return snapshotError(err)
+			}
+			if expire != 0 {
+				item.Expire = time.Unix(0, expire)
+			}
+			b, err := sr.bytes()
+			if err != nil {
+				return snapshotError(err)
+			}
+			item.Value = ByteView{b: b, e: item.Expire}
+		}
+		n, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return snapshotError(err)
+		}
+		for i := uint64(0); i < n; i++ {
+			ref, err := binary.ReadUvarint(sr)
+			if err != nil {
+				return snapshotError(err)
+			}
+			item.Refs = append(item.Refs, ref)
+		}
+		items = append(items, item)
+	}
+
+	want := sr.crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(sr.r, sum[:]); err != nil {
+		return snapshotError(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != want {
+		return ErrBadSnapshot
+	}
+	g.mainCache.restore(items)
+	return nil
+}
+
+// snapshotError reports a snapshot cut short as corrupted
+func snapshotError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrBadSnapshot
+	}
+	return err
+}
+
+// snapshotReader checksums what it reads
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.crc.Write(p[:n])
+	return n, err
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// bytes reads a length and as many bytes. The buffer grows with the data
+// actually read, so a damaged length does not allocate it all at once.
+func (sr *snapshotReader) bytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, sr, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}